@@ -5,6 +5,7 @@ go 1.24.9
 require (
 	github.com/esrrhs/gohome v0.0.0-20251230021531-10dd8849d958
 	google.golang.org/protobuf v1.36.11
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// access log里每个连接关闭时的一行
+type AccessRecord struct {
+	Time      time.Time `json:"time"` // 关闭的时间
+	Role      string    `json:"role"` // server client
+	Side      string    `json:"side"` // inputer outputer
+	Client    string    `json:"client"`
+	Id        string    `json:"id"`
+	Source    string    `json:"source,omitempty"`
+	Target    string    `json:"target"`
+	User      string    `json:"user,omitempty"` // socks用户名
+	OpenMs    float64   `json:"open_ms"`        // inputer是等到OPENRSP的时间，outputer是连目标的时间
+	RecvBytes int64     `json:"recv_bytes"`     // 从本地连接读到的字节
+	SendBytes int64     `json:"send_bytes"`     // 写给本地连接的字节
+	Duration  float64   `json:"duration_ms"`
+	Reason    string    `json:"reason"`
+}
+
+type accessLog struct {
+	lock       sync.Mutex
+	filename   string
+	maxsize    int64
+	maxbackups int
+	file       *os.File
+	size       int64
+	closed     bool
+	refs       int // 打开它的Server和Client数，gAccessLogsLock保护，减到0关掉文件
+}
+
+var gAccessLogs = make(map[string]*accessLog)
+var gAccessLogsLock sync.Mutex
+
+// 同一个文件在进程里只有一份，Server和Client打开时加引用，轮转按最后一次打开或者重新加载的配置，没配置时返回nil
+func openAccessLog(config *Config) (*accessLog, error) {
+	if len(config.AccessLog) <= 0 {
+		return nil, nil
+	}
+
+	gAccessLogsLock.Lock()
+	defer gAccessLogsLock.Unlock()
+
+	if l, ok := gAccessLogs[config.AccessLog]; ok {
+		l.refs++
+		l.setRotation(config)
+		return l, nil
+	}
+
+	l := &accessLog{
+		filename:   config.AccessLog,
+		maxsize:    int64(config.AccessLogMaxSize) * 1024 * 1024,
+		maxbackups: config.AccessLogMaxBackups,
+		refs:       1,
+	}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+
+	gAccessLogs[config.AccessLog] = l
+	loggo.Info("open access log %s", config.AccessLog)
+	return l, nil
+}
+
+// 最后一个用它的Server或者Client关闭时关掉文件
+func closeAccessLog(l *accessLog) {
+	if l == nil {
+		return
+	}
+
+	gAccessLogsLock.Lock()
+	defer gAccessLogsLock.Unlock()
+
+	l.refs--
+	if l.refs > 0 {
+		return
+	}
+	if gAccessLogs[l.filename] == l {
+		delete(gAccessLogs, l.filename)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.closed = true
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	loggo.Info("close access log %s", l.filename)
+}
+
+// 已经打开的access log，没打开返回nil
+func getAccessLog(config *Config) *accessLog {
+	if len(config.AccessLog) <= 0 {
+		return nil
+	}
+
+	gAccessLogsLock.Lock()
+	defer gAccessLogsLock.Unlock()
+
+	return gAccessLogs[config.AccessLog]
+}
+
+// 重新加载时换成新的轮转配置
+func reloadAccessLog(config *Config) {
+	l := getAccessLog(config)
+	if l != nil {
+		l.setRotation(config)
+	}
+}
+
+func (l *accessLog) setRotation(config *Config) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.maxsize = int64(config.AccessLogMaxSize) * 1024 * 1024
+	l.maxbackups = config.AccessLogMaxBackups
+}
+
+func (l *accessLog) open() error {
+	file, err := os.OpenFile(l.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = fi.Size()
+	return nil
+}
+
+// 当前文件改名成.1，原来的.1改成.2，超过maxbackups的删掉
+func (l *accessLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	if l.maxbackups <= 0 {
+		os.Remove(l.filename)
+	} else {
+		os.Remove(l.filename + "." + strconv.Itoa(l.maxbackups))
+		for i := l.maxbackups - 1; i > 0; i-- {
+			os.Rename(l.filename+"."+strconv.Itoa(i), l.filename+"."+strconv.Itoa(i+1))
+		}
+		err := os.Rename(l.filename, l.filename+".1")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return l.open()
+}
+
+func (l *accessLog) write(r *AccessRecord) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		loggo.Error("access log Marshal fail %s %s", l.filename, err)
+		return
+	}
+	data = append(data, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	if l.file != nil && l.maxsize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxsize {
+		err = l.rotate()
+		if err != nil {
+			loggo.Error("access log rotate fail %s %s", l.filename, err)
+		}
+	}
+	if l.file == nil {
+		// 轮转时打开失败，下次再试
+		err = l.open()
+		if err != nil {
+			loggo.Error("access log open fail %s %s", l.filename, err)
+			return
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		loggo.Error("access log write fail %s %s", l.filename, err)
+	}
+}
+
+// 第一个原因有效，后面因为连接关掉引起的错误不覆盖
+func (p *ProxyConn) setCloseReason(reason string) {
+	p.closereason.CompareAndSwap(nil, &reason)
+}
+
+func (p *ProxyConn) getCloseReason() string {
+	reason := p.closereason.Load()
+	if reason == nil {
+		return ""
+	}
+	return *reason
+}
+
+// 连接结束时写一行，err是连接的group退出的原因
+func writeAccessLog(config *Config, side string, sonny *ProxyConn, err error) {
+	l := getAccessLog(config)
+	if l == nil {
+		return
+	}
+
+	if err != nil {
+		sonny.setCloseReason(err.Error())
+	} else {
+		sonny.setCloseReason("close")
+	}
+
+	r := &AccessRecord{
+		Time:      time.Now(),
+		Side:      side,
+		Id:        sonny.id,
+		Source:    sonny.source,
+		Target:    sonny.target,
+		User:      sonny.user,
+		OpenMs:    float64(sonny.opentime) / float64(time.Millisecond),
+		RecvBytes: atomic.LoadInt64(&sonny.recvsize),
+		SendBytes: atomic.LoadInt64(&sonny.sendsize),
+		Reason:    sonny.getCloseReason(),
+	}
+	if sonny.father != nil {
+		r.Role, r.Client = sonny.father.role, sonny.father.loginname
+	}
+	if !sonny.begin.IsZero() {
+		r.Duration = float64(time.Since(sonny.begin)) / float64(time.Millisecond)
+	}
+	l.write(r)
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func readAccessLog(filename string) ([]*AccessRecord, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var ret []*AccessRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r AccessRecord
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, &r)
+	}
+	return ret, scanner.Err()
+}
+
+func waitAccessRecord(filename string, target string, timeout time.Duration) (*AccessRecord, error) {
+	var err error
+	begin := time.Now()
+	for time.Since(begin) < timeout {
+		var records []*AccessRecord
+		records, err = readAccessLog(filename)
+		for _, r := range records {
+			if r.Target == target {
+				return r, nil
+			}
+		}
+		if err == nil {
+			err = echoError("no access record " + target)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return nil, err
+}
+
+func Test0021AccessLog(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	echo := startEcho(t, "tcp", "127.0.0.1:33702")
+	defer echo.Close()
+
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.AccessLog = filepath.Join(dir, "server.log")
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:33700"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 本地连接关掉以后等不活跃超时才结束，checkSonnyActive过了EstablishedTimeout才开始算
+	cconfig := DefaultConfig()
+	cconfig.AccessLog = filepath.Join(dir, "client.log")
+	cconfig.EstablishedTimeout = 2
+	cconfig.ConnTimeout = 2
+	cconfig.Username = "user"
+	cconfig.Password = "pass"
+	c, err := NewClient(cconfig, "tcp", "127.0.0.1:33700", "test_accesslog", "SOCKS5", []string{"tcp"}, []string{"127.0.0.1:33701"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var lasterr error
+	begin := time.Now()
+	for time.Since(begin) < 10*time.Second {
+		lasterr = trySocks4Connect("127.0.0.1:33701", "user:pass", "127.0.0.1", 33702)
+		if lasterr == nil {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if lasterr != nil {
+		t.Fatal(lasterr)
+	}
+
+	// 没人监听的目标
+	trySocks4Connect("127.0.0.1:33701", "user:pass", "127.0.0.1", 33705)
+
+	size := int64(len("hello spp socks4 connect"))
+	cr, err := waitAccessRecord(cconfig.AccessLog, "127.0.0.1:33702", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Role != "client" || cr.Side != "inputer" || cr.Client != "test_accesslog_0" || cr.User != "user" ||
+		!strings.HasPrefix(cr.Source, "127.0.0.1:") || cr.OpenMs <= 0 || cr.RecvBytes != size || cr.SendBytes != size ||
+		cr.Duration < cr.OpenMs || cr.Reason != "local eof" {
+		t.Fatal("client record error", cr)
+	}
+
+	sr, err := waitAccessRecord(config.AccessLog, "127.0.0.1:33702", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Role != "server" || sr.Side != "outputer" || sr.Client != "test_accesslog_0" || sr.Id != cr.Id || sr.User != "user" ||
+		sr.Source != cr.Source || sr.RecvBytes != size || sr.SendBytes != size || sr.Reason != "close by remote" {
+		t.Fatal("server record error", sr)
+	}
+
+	fr, err := waitAccessRecord(config.AccessLog, "127.0.0.1:33705", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Reason != "open fail Dial fail 127.0.0.1:33705" {
+		t.Fatal("server fail record error", fr)
+	}
+	fr, err = waitAccessRecord(cconfig.AccessLog, "127.0.0.1:33705", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Reason != "open fail Dial fail 127.0.0.1:33705" {
+		t.Fatal("client fail record error", fr)
+	}
+
+	// 按大小轮转，只留两个旧文件
+	filename := filepath.Join(dir, "rotate.log")
+	l := &accessLog{filename: filename, maxsize: 400, maxbackups: 2}
+	if err := l.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.file.Close()
+
+	for i := 0; i < 20; i++ {
+		l.write(&AccessRecord{Id: strconv.Itoa(i), Target: "127.0.0.1:80", Reason: "close"})
+	}
+
+	last := 20
+	for _, name := range []string{filename, filename + ".1", filename + ".2"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > l.maxsize {
+			t.Fatal("rotate size error", name, fi.Size())
+		}
+		records, err := readAccessLog(name)
+		if err != nil || len(records) <= 0 {
+			t.Fatal("read rotate error", name, err)
+		}
+		// 新的在前面的文件里，每个文件内部按顺序
+		id, _ := strconv.Atoi(records[len(records)-1].Id)
+		if id >= last {
+			t.Fatal("rotate order error", name, id, last)
+		}
+		last, _ = strconv.Atoi(records[0].Id)
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Fatal("too many backups", err)
+	}
+
+	// 同一个文件共用一份，后打开和重新加载的轮转配置生效
+	rconfig := DefaultConfig()
+	rconfig.AccessLog = filepath.Join(dir, "reload.log")
+	l1, err := openAccessLog(rconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nconfig := *rconfig
+	nconfig.AccessLogMaxSize = 1
+	l2, err := openAccessLog(&nconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l1 != l2 || l1.maxsize != 1024*1024 {
+		t.Fatal("open access log again should share and apply the rotation", l1.maxsize)
+	}
+	nconfig.AccessLogMaxBackups = 1
+	reloadAccessLog(&nconfig)
+	if l1.maxbackups != 1 {
+		t.Fatal("reload access log rotation error", l1.maxbackups)
+	}
+
+	// 最后一个用它的关掉时关文件
+	closeAccessLog(l1)
+	if getAccessLog(rconfig) != l2 || l2.file == nil {
+		t.Fatal("access log closed too early")
+	}
+	closeAccessLog(l2)
+	if getAccessLog(rconfig) != nil || l2.file != nil {
+		t.Fatal("access log not closed")
+	}
+
+	c.Close()
+	s.Close()
+	if getAccessLog(config) != nil || getAccessLog(cconfig) != nil {
+		t.Fatal("access log not closed after server and client close")
+	}
+}
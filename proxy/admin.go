@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/thread"
+)
+
+// 管理接口返回的client
+type AdminClient struct {
+	Key       string        `json:"key"` // clients里的key，踢掉client时用
+	Name      string        `json:"name"`
+	Type      string        `json:"type"`
+	Proto     string        `json:"proto"`
+	Fromaddr  string        `json:"fromaddr"`
+	Toaddr    string        `json:"toaddr"`
+	Addr      string        `json:"addr"`
+	Group     string        `json:"group,omitempty"`
+	Goaway    bool          `json:"goaway,omitempty"` // 发过GOAWAY，等client换主通道
+	Rtt       float64       `json:"rtt_ms"`
+	Age       int64         `json:"age"` // 秒
+	RecvBytes int64         `json:"recv_bytes"`
+	SendBytes int64         `json:"send_bytes"`
+	Streams   []AdminStream `json:"streams"`
+}
+
+// 管理接口返回的连接，转发给别的client的连接target是对端client的名字
+type AdminStream struct {
+	Id        string `json:"id"`
+	Target    string `json:"target"`
+	Age       int64  `json:"age"` // 秒
+	RecvBytes int64  `json:"recv_bytes"`
+	SendBytes int64  `json:"send_bytes"`
+}
+
+func adminAge(begin time.Time) int64 {
+	if begin.IsZero() {
+		return 0
+	}
+	return int64(time.Since(begin).Seconds())
+}
+
+func (s *Server) listenAdmin(wg *thread.Group) error {
+	config := s.getConfig()
+	if len(config.Admin) <= 0 {
+		return nil
+	}
+	if len(config.AdminToken) <= 0 {
+		return errors.New("admin need admin-token")
+	}
+
+	listener, err := net.Listen("tcp", config.Admin)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/clients", s.serveAdminClients)
+	mux.HandleFunc("GET /api/clients/{key}", s.serveAdminClient)
+	mux.HandleFunc("POST /api/clients/{key}/kick", s.serveAdminKick)
+	mux.HandleFunc("POST /api/clients/{key}/goaway", s.serveAdminGoaway)
+	mux.HandleFunc("POST /api/streams/{id}/close", s.serveAdminCloseStream)
+	mux.HandleFunc("GET /api/stats", s.serveAdminStats)
+	mux.HandleFunc("GET /api/ratelimits", s.serveAdminRateLimits)
+	mux.HandleFunc("POST /api/ratelimits/{name}", s.serveAdminSetRateLimit)
+	mux.HandleFunc("GET /api/fair", s.serveAdminFair)
+
+	server := NewHttpServer(config, s.checkAdminToken(mux))
+	s.adminServer = server
+	wg.Go("Server admin"+" "+config.Admin, func() error {
+		loggo.Info("admin start %s", config.Admin)
+		server.Serve(listener)
+		loggo.Info("admin end %s", config.Admin)
+		return nil
+	})
+	return nil
+}
+
+// token每次从当前配置取，重新加载后马上生效
+func (s *Server) checkAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.getConfig().AdminToken)) != 1 {
+			loggo.Info("admin auth fail %s %s", req.RemoteAddr, req.URL.Path)
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func writeAdminJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// 已经登录的client，按key排序
+func (s *Server) Clients() []*AdminClient {
+	var ret []*AdminClient
+	s.clients.Range(func(key, value interface{}) bool {
+		clientconn := value.(*ClientConn)
+		if clientconn.established.Load() {
+			ret = append(ret, s.adminClient(clientconn))
+		}
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key < ret[j].Key
+	})
+	return ret
+}
+
+func (s *Server) adminClient(clientconn *ClientConn) *AdminClient {
+	c := &AdminClient{
+		Key:       clientconn.key,
+		Name:      clientconn.name,
+		Type:      clientconn.clienttype.String(),
+		Proto:     clientconn.proxyproto.String(),
+		Fromaddr:  clientconn.fromaddr,
+		Toaddr:    clientconn.toaddr,
+		Addr:      clientconn.conn.Info(),
+		Rtt:       float64(clientconn.getRtt()) / float64(time.Millisecond),
+		Age:       adminAge(clientconn.begin),
+		RecvBytes: atomic.LoadInt64(&clientconn.recvsize),
+		SendBytes: atomic.LoadInt64(&clientconn.sendsize),
+		Goaway:    clientconn.isGoaway(),
+		Streams:   []AdminStream{},
+	}
+	if clientconn.group != nil {
+		c.Group = clientconn.group.name
+	}
+
+	s.rangeStreams(clientconn, func(stream AdminStream, closefunc func()) bool {
+		c.Streams = append(c.Streams, stream)
+		return true
+	})
+	sort.Slice(c.Streams, func(i, j int) bool {
+		return c.Streams[i].Id < c.Streams[j].Id
+	})
+	return c
+}
+
+func adminSonnyStream(sonny *ProxyConn) AdminStream {
+	return AdminStream{
+		Id:        sonny.id,
+		Target:    sonny.target,
+		Age:       adminAge(sonny.begin),
+		RecvBytes: atomic.LoadInt64(&sonny.recvsize),
+		SendBytes: atomic.LoadInt64(&sonny.sendsize),
+	}
+}
+
+// 遍历client的连接，包括Inputer Outputer上的和经过server转发的，closefunc关掉这个连接
+func (s *Server) rangeStreams(clientconn *ClientConn, f func(stream AdminStream, closefunc func()) bool) {
+	father := &clientconn.ProxyConn
+	cont := true
+
+	rangeSonny := func(key, value interface{}) bool {
+		sonny := value.(*ProxyConn)
+		// 服务组的Inputer是成员共用的
+		if sonny.father != father {
+			return true
+		}
+		cont = f(adminSonnyStream(sonny), func() {
+			sonny.setCloseReason("admin close")
+			sonny.needclose.Store(true)
+		})
+		return cont
+	}
+	if clientconn.output != nil {
+		clientconn.output.sonny.Range(rangeSonny)
+	}
+	if cont && clientconn.input != nil {
+		clientconn.input.sonny.Range(rangeSonny)
+	}
+	if !cont {
+		return
+	}
+
+	s.relays.Range(func(key, value interface{}) bool {
+		relay := value.(*clientRelay)
+		var stream AdminStream
+		if relay.visitor == clientconn {
+			stream = AdminStream{Id: relay.id, Target: relay.provider.name,
+				RecvBytes: atomic.LoadInt64(&relay.upsize), SendBytes: atomic.LoadInt64(&relay.downsize)}
+		} else if relay.provider == clientconn {
+			stream = AdminStream{Id: relay.id, Target: relay.visitor.name,
+				RecvBytes: atomic.LoadInt64(&relay.downsize), SendBytes: atomic.LoadInt64(&relay.upsize)}
+		} else {
+			return true
+		}
+		stream.Age = adminAge(relay.begin)
+		return f(stream, func() {
+			s.deleteRelay(relay.id)
+			closeRemoteConn(&ProxyConn{id: relay.id}, &relay.visitor.ProxyConn)
+			closeRemoteConn(&ProxyConn{id: relay.id}, &relay.provider.ProxyConn)
+		})
+	})
+}
+
+// 踢掉client，主通道在checkNeedClose里断开
+func (s *Server) KickClient(key string) bool {
+	v, ok := s.clients.Load(key)
+	if !ok {
+		return false
+	}
+	clientconn := v.(*ClientConn)
+	clientconn.needclose.Store(true)
+	loggo.Info("KickClient %s %s", key, clientconn.conn.Info())
+	return true
+}
+
+// 让client换一条主通道，proto addr不为空时换到这个地址，已有的连接在旧的主通道上结束
+func (s *Server) GoawayClient(key string, proto string, addr string) bool {
+	v, ok := s.clients.Load(key)
+	if !ok {
+		return false
+	}
+	clientconn := v.(*ClientConn)
+	if !clientconn.established.Load() {
+		return false
+	}
+	s.sendGoaway(clientconn, "goaway", proto, addr)
+	loggo.Info("GoawayClient %s %s %s %s", key, clientconn.conn.Info(), proto, addr)
+	return true
+}
+
+func (s *Server) CloseStream(id string) bool {
+	found := false
+	s.clients.Range(func(key, value interface{}) bool {
+		clientconn := value.(*ClientConn)
+		s.rangeStreams(clientconn, func(stream AdminStream, closefunc func()) bool {
+			if stream.Id == id {
+				closefunc()
+				found = true
+			}
+			return !found
+		})
+		return !found
+	})
+	if found {
+		loggo.Info("CloseStream %s", id)
+	}
+	return found
+}
+
+func (s *Server) serveAdminClients(w http.ResponseWriter, req *http.Request) {
+	clients := s.Clients()
+	if clients == nil {
+		clients = []*AdminClient{}
+	}
+	writeAdminJson(w, clients)
+}
+
+func (s *Server) serveAdminClient(w http.ResponseWriter, req *http.Request) {
+	v, ok := s.clients.Load(req.PathValue("key"))
+	if !ok || !v.(*ClientConn).established.Load() {
+		writeAdminError(w, http.StatusNotFound, "no client "+req.PathValue("key"))
+		return
+	}
+	writeAdminJson(w, s.adminClient(v.(*ClientConn)))
+}
+
+func (s *Server) serveAdminKick(w http.ResponseWriter, req *http.Request) {
+	if !s.KickClient(req.PathValue("key")) {
+		writeAdminError(w, http.StatusNotFound, "no client "+req.PathValue("key"))
+		return
+	}
+	writeAdminJson(w, map[string]string{"result": "ok"})
+}
+
+func (s *Server) serveAdminGoaway(w http.ResponseWriter, req *http.Request) {
+	if !s.GoawayClient(req.PathValue("key"), req.URL.Query().Get("proto"), req.URL.Query().Get("addr")) {
+		writeAdminError(w, http.StatusNotFound, "no client "+req.PathValue("key"))
+		return
+	}
+	writeAdminJson(w, map[string]string{"result": "ok"})
+}
+
+func (s *Server) serveAdminCloseStream(w http.ResponseWriter, req *http.Request) {
+	if !s.CloseStream(req.PathValue("id")) {
+		writeAdminError(w, http.StatusNotFound, "no stream "+req.PathValue("id"))
+		return
+	}
+	writeAdminJson(w, map[string]string{"result": "ok"})
+}
+
+func (s *Server) serveAdminStats(w http.ResponseWriter, req *http.Request) {
+	stats := s.Stats()
+	if stats == nil {
+		stats = []*TrafficStats{}
+	}
+	writeAdminJson(w, stats)
+}
+
+func (s *Server) serveAdminFair(w http.ResponseWriter, req *http.Request) {
+	stats := s.FairStats()
+	if stats == nil {
+		stats = []*FairStats{}
+	}
+	writeAdminJson(w, stats)
+}
+
+func (s *Server) serveAdminRateLimits(w http.ResponseWriter, req *http.Request) {
+	writeAdminJson(w, s.RateLimits())
+}
+
+// 没带的参数保持原来的值
+func (s *Server) serveAdminSetRateLimit(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	r := s.getRateLimit(name)
+	for key, v := range map[string]*int{"rate": &r.Rate, "burst": &r.Burst, "stream": &r.Stream} {
+		str := req.URL.Query().Get(key)
+		if len(str) <= 0 {
+			continue
+		}
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			writeAdminError(w, http.StatusBadRequest, "error "+key+" "+str)
+			return
+		}
+		*v = n
+	}
+	s.SetRateLimit(name, r)
+	writeAdminJson(w, r)
+}
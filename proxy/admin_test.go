@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func adminRequest(method string, url string, token string, v interface{}) (int, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+	if v != nil && rsp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(rsp.Body).Decode(v)
+	}
+	return rsp.StatusCode, err
+}
+
+func Test0018Admin(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	echo := startEcho(t, "tcp", "127.0.0.1:33402")
+	defer echo.Close()
+
+	config := DefaultConfig()
+	config.Admin = "127.0.0.1:33401"
+	if _, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:33400"}); err == nil {
+		t.Fatal("admin without token should fail")
+	}
+
+	config.AdminToken = "abc"
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:33400"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := NewClient(DefaultConfig(), "tcp", "127.0.0.1:33400", "test_admin", "PROXY", []string{"tcp"}, []string{"127.0.0.1:33403"}, []string{"127.0.0.1:33402"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := checkEcho("tcp", "127.0.0.1:33403", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:33403")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := echoOnce(conn, []byte("hello spp admin")); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _ := adminRequest("GET", "http://127.0.0.1:33401/api/clients", "wrong", nil); code != http.StatusUnauthorized {
+		t.Fatal("wrong token", code)
+	}
+
+	var clients []*AdminClient
+	if code, err := adminRequest("GET", "http://127.0.0.1:33401/api/clients", "abc", &clients); code != http.StatusOK || err != nil {
+		t.Fatal("clients", code, err)
+	}
+	if len(clients) != 1 || clients[0].Type != "PROXY" || clients[0].RecvBytes <= 0 || clients[0].SendBytes <= 0 {
+		t.Fatal("clients error", clients)
+	}
+	// checkEcho的连接可能还没超时关掉，按字节数找conn的
+	var stream *AdminStream
+	for i, _ := range clients[0].Streams {
+		if clients[0].Streams[i].Target == "127.0.0.1:33402" && clients[0].Streams[i].SendBytes == int64(len("hello spp admin")) {
+			stream = &clients[0].Streams[i]
+		}
+	}
+	if stream == nil {
+		t.Fatal("no stream", clients[0].Streams)
+	}
+
+	var client AdminClient
+	if code, err := adminRequest("GET", "http://127.0.0.1:33401/api/clients/"+clients[0].Key, "abc", &client); code != http.StatusOK || err != nil || client.Name != clients[0].Name {
+		t.Fatal("client", code, err, client)
+	}
+
+	if code, _ := adminRequest("POST", "http://127.0.0.1:33401/api/streams/"+stream.Id+"/close", "abc", nil); code != http.StatusOK {
+		t.Fatal("close stream", code)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatal("stream should be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("stream close timeout")
+	}
+
+	if code, _ := adminRequest("POST", "http://127.0.0.1:33401/api/streams/nostream/close", "abc", nil); code != http.StatusNotFound {
+		t.Fatal("close no stream", code)
+	}
+	if code, _ := adminRequest("POST", "http://127.0.0.1:33401/api/clients/noclient/kick", "abc", nil); code != http.StatusNotFound {
+		t.Fatal("kick no client", code)
+	}
+
+	begin := clients[0].Age
+	time.Sleep(1100 * time.Millisecond)
+	if code, _ := adminRequest("POST", "http://127.0.0.1:33401/api/clients/"+clients[0].Key+"/kick", "abc", nil); code != http.StatusOK {
+		t.Fatal("kick", code)
+	}
+
+	// 踢掉后client会重连上来，重新计时
+	var lasterr error
+	start := time.Now()
+	for time.Since(start) < 10*time.Second {
+		time.Sleep(500 * time.Millisecond)
+		clients = nil
+		adminRequest("GET", "http://127.0.0.1:33401/api/clients", "abc", &clients)
+		if len(clients) == 1 && clients[0].Age <= begin && clients[0].RecvBytes < client.RecvBytes {
+			lasterr = nil
+			break
+		}
+		lasterr = echoError("client not kicked")
+	}
+	if lasterr != nil {
+		t.Fatal(lasterr, clients)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/esrrhs/gohome/common"
@@ -14,34 +16,58 @@ import (
 
 type ServerConn struct {
 	ProxyConn
-	output *Outputer
-	input  *Inputer
+	output    *Outputer
+	input     *Inputer
+	endpoint  *endpoint
+	migrating bool
+	goaway    int32 // 收到GOAWAY，不再开新的连接
 }
 
 type Client struct {
 	config     *Config
-	server     string
+	endpoints  []*endpoint
 	name       string
 	clienttype CLIENT_TYPE
 	proxyproto []PROXY_PROTO
 	fromaddr   []string
 	toaddr     []string
+	lock       sync.Mutex // 保护下面三个，connect、process和probe的goroutine都会用
 	serverconn []*ServerConn
+	retired    []*ServerConn // 收到GOAWAY、等连接结束的旧主通道
+	next       []*endpoint   // GOAWAY指定的下次连接的地址
 	wg         *thread.Group
+	retry      int32
+	traffic    *trafficTotals
+	ratelimits []*rateLimiter            // 每个隧道一个
+	draining   int32                     // Shutdown开始以后不再接受新的连接
+	accesslog  atomic.Pointer[accessLog] // Close时放掉引用
 }
 
 func NewClient(config *Config, serverproto string, server string, name string, clienttypestr string, proxyprotostr []string, fromaddr []string, toaddr []string) (*Client, error) {
+	return NewMultiClient(config, []Endpoint{{Proto: serverproto, Addr: server}}, name, clienttypestr, proxyprotostr, fromaddr, toaddr)
+}
+
+func NewMultiClient(config *Config, servers []Endpoint, name string, clienttypestr string, proxyprotostr []string, fromaddr []string, toaddr []string) (*Client, error) {
 
 	if config == nil {
 		config = DefaultConfig()
 	}
 
-	cn, err := network.NewConn(serverproto)
-	if cn == nil {
-		return nil, err
+	if len(servers) == 0 {
+		return nil, errors.New("no server")
 	}
 
-	setCongestion(cn, config)
+	var endpoints []*endpoint
+	for i, _ := range servers {
+		cn, err := network.NewConn(servers[i].Proto)
+		if cn == nil {
+			return nil, err
+		}
+
+		setCongestion(cn, config)
+
+		endpoints = append(endpoints, &endpoint{Endpoint: servers[i], conn: cn, alive: 1})
+	}
 
 	clienttypestr = strings.ToUpper(clienttypestr)
 	clienttype, ok := CLIENT_TYPE_value[clienttypestr]
@@ -58,24 +84,59 @@ func NewClient(config *Config, serverproto string, server string, name string, c
 		proxyproto = append(proxyproto, PROXY_PROTO(p))
 	}
 
+	err := checkClientConfig(config, servers, CLIENT_TYPE(clienttype), fromaddr, toaddr)
+	if err != nil {
+		return nil, err
+	}
+
+	traffic, err := getTrafficTotals(config.StatsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	accesslog, err := openAccessLog(config)
+	if err != nil {
+		return nil, err
+	}
+
 	wg := thread.NewGroup("Clent"+" "+clienttypestr, nil, nil)
 
+	var ratelimits []*rateLimiter
+	for range proxyprotostr {
+		ratelimits = append(ratelimits, newRateLimiter(configRateLimit(config)))
+	}
+
 	c := &Client{
 		config:     config,
-		server:     server,
+		endpoints:  endpoints,
 		name:       name,
 		clienttype: CLIENT_TYPE(clienttype),
 		proxyproto: proxyproto,
 		fromaddr:   fromaddr,
 		toaddr:     toaddr,
 		serverconn: make([]*ServerConn, len(proxyprotostr)),
+		retired:    make([]*ServerConn, len(proxyprotostr)),
+		next:       make([]*endpoint, len(proxyprotostr)),
 		wg:         wg,
+		traffic:    traffic,
+		ratelimits: ratelimits,
 	}
+	c.accesslog.Store(accesslog)
 
 	wg.Go("Client state"+" "+clienttypestr, func() error {
 		return showState(wg)
 	})
 
+	wg.Go("Client saveTrafficStats"+" "+clienttypestr, func() error {
+		return saveTrafficStats(wg, traffic)
+	})
+
+	if len(endpoints) > 1 {
+		wg.Go("Client probeEndpoints"+" "+clienttypestr, func() error {
+			return c.probeEndpoints()
+		})
+	}
+
 	for i, _ := range proxyprotostr {
 		index := i
 		toaddrstr := ""
@@ -83,20 +144,92 @@ func NewClient(config *Config, serverproto string, server string, name string, c
 			toaddrstr = toaddr[i]
 		}
 		wg.Go("Client connect"+" "+fromaddr[i]+" "+toaddrstr, func() error {
-			return c.connect(index, cn)
+			return c.connect(index)
 		})
 	}
 
 	return c, nil
 }
 
+// client的配置检查，配置文件加载时也用
+func checkClientConfig(config *Config, servers []Endpoint, clienttype CLIENT_TYPE, fromaddr []string, toaddr []string) error {
+	if len(config.UpstreamProxy) > 0 {
+		err := checkUpstreamProxy(config.UpstreamProxy)
+		if err != nil {
+			return err
+		}
+		// 只有tcp的主通道可以经过上游代理
+		for _, server := range servers {
+			if server.Proto != "tcp" {
+				return errors.New("upstream proxy only support tcp proto, not " + server.Proto)
+			}
+		}
+	}
+
+	if len(config.Group) > 0 {
+		if clienttype != CLIENT_TYPE_REVERSE_PROXY {
+			return errors.New("group only support REVERSE_PROXY")
+		}
+		err := checkGroupBalance(config.GroupBalance)
+		if err != nil {
+			return err
+		}
+	}
+
+	if clienttype == CLIENT_TYPE_SECRET || clienttype == CLIENT_TYPE_SECRET_VISITOR {
+		if len(config.Secret) <= 0 {
+			return errors.New("no secret")
+		}
+	}
+
+	err := checkProxyProtocol(config.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+
+	err = checkTrustedProxies(config)
+	if err != nil {
+		return err
+	}
+
+	if len(config.Exit) > 0 && clienttype != CLIENT_TYPE_SOCKS5 {
+		return errors.New("exit only support SOCKS5")
+	}
+
+	if config.AllowExit && !isExitType(clienttype) {
+		return errors.New("allow exit only support REVERSE_SOCKS5 and REVERSE_HTTP_PROXY")
+	}
+
+	if (len(config.Exit) > 0 || config.AllowExit) && len(config.ExitSecret) <= 0 {
+		return errors.New("no exit secret")
+	}
+
+	if clienttype == CLIENT_TYPE_PROXY || clienttype == CLIENT_TYPE_REVERSE_PROXY {
+		for i, _ := range fromaddr {
+			if i < len(toaddr) && !isVhostAddr(fromaddr[i]) {
+				_, _, err := splitPortRange(fromaddr[i], toaddr[i])
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 func (c *Client) Close() {
 	c.wg.Stop()
 	c.wg.Wait()
+	err := c.traffic.save()
+	if err != nil {
+		loggo.Error("Client Close save traffic stats fail %s %s", c.traffic.filename, err)
+	}
+	closeAccessLog(c.accesslog.Swap(nil))
 }
 
-func (c *Client) connect(index int, conn network.Conn) error {
-	loggo.Info("connect start %d %s", index, c.server)
+func (c *Client) connect(index int) error {
+	loggo.Info("connect start %d %d", index, len(c.endpoints))
 
 	// 创建一个定时器
 	checkTicker := time.NewTicker(time.Second)
@@ -112,21 +245,38 @@ func (c *Client) connect(index int, conn network.Conn) error {
 			break
 			// 2. 定时器触发逻辑
 		case <-checkTicker.C:
-			if c.serverconn[index] == nil {
-				targetconn, err := conn.Dial(c.server)
-				if err != nil {
-					loggo.Error("connect Dial fail: %s %s", c.server, err.Error())
-					break
-				}
-				c.serverconn[index] = &ServerConn{ProxyConn: ProxyConn{conn: targetconn}}
-				c.wg.Go("Client useServer"+" "+targetconn.Info(), func() error {
-					return c.useServer(index, c.serverconn[index])
-				})
+			if c.isDraining() {
+				break
+			}
+			c.lock.Lock()
+			if c.serverconn[index] != nil {
+				c.lock.Unlock()
+				break
 			}
+			ep := c.next[index]
+			c.next[index] = nil
+			c.lock.Unlock()
+
+			if ep == nil {
+				ep = c.pickEndpoint()
+			}
+			targetconn, err := dialServer(ep.conn, ep.Addr, c.config)
+			if err != nil {
+				loggo.Error("connect Dial fail: %s %s %s", ep.Proto, ep.Addr, err.Error())
+				c.failEndpoint(ep)
+				break
+			}
+			serverconn := &ServerConn{ProxyConn: ProxyConn{conn: targetconn}, endpoint: ep}
+			c.lock.Lock()
+			c.serverconn[index] = serverconn
+			c.lock.Unlock()
+			c.wg.Go("Client useServer"+" "+targetconn.Info(), func() error {
+				return c.useServer(index, serverconn)
+			})
 		}
 	}
 
-	loggo.Info("connect end %s", c.server)
+	loggo.Info("connect end %d", index)
 	return nil
 }
 
@@ -154,18 +304,27 @@ func (c *Client) useServer(index int, serverconn *ServerConn) error {
 		loggo.Info("group end exit %s", serverconn.conn.Info())
 	})
 
-	c.login(index, sendch)
+	var toaddr string
+	if len(c.toaddr) > 0 {
+		toaddr = c.toaddr[index]
+	}
+	serverconn.role = "client"
+	serverconn.loginname = c.name + "_" + strconv.Itoa(index)
+	serverconn.metrics.Store(getMetrics("client", serverconn.loginname, c.fromaddr[index], toaddr, c.proxyproto[index]))
+	serverconn.ratelimit.Store(c.ratelimits[index])
+
+	c.login(index, sendch, serverconn)
 
 	var pingflag int32
 	var pongflag int32
 	var pongtime int64
 
 	wg.Go("Client recvFrom"+" "+serverconn.conn.Info(), func() error {
-		return recvFrom(wg, recvch, serverconn.conn, c.config.MaxMsgSize, c.config.Encrypt)
+		return recvFrom(wg, recvch, serverconn.conn, c.config.MaxMsgSize, c.config.Encrypt, &serverconn.ProxyConn)
 	})
 
 	wg.Go("Client sendTo"+" "+serverconn.conn.Info(), func() error {
-		return sendTo(wg, sendch, serverconn.conn, c.config.Compress, c.config.MaxMsgSize, c.config.Encrypt, &pingflag, &pongflag, &pongtime)
+		return sendTo(wg, sendch, serverconn.conn, c.config.Compress, c.config.MaxMsgSize, c.config.Encrypt, &pingflag, &pongflag, &pongtime, &serverconn.ProxyConn)
 	})
 
 	wg.Go("Client checkPingActive"+" "+serverconn.conn.Info(), func() error {
@@ -181,13 +340,61 @@ func (c *Client) useServer(index int, serverconn *ServerConn) error {
 	})
 
 	wg.Wait()
-	c.serverconn[index] = nil
-	loggo.Info("useServer close %s %s", c.server, serverconn.conn.Info())
+	c.traffic.offline(&serverconn.ProxyConn)
+	releaseMetrics(serverconn.getMetrics())
+	c.lock.Lock()
+	if c.serverconn[index] == serverconn {
+		c.serverconn[index] = nil
+	}
+	if c.retired[index] == serverconn {
+		c.retired[index] = nil
+	}
+	migrating := serverconn.migrating
+	c.lock.Unlock()
+	if !c.wg.IsExit() && !migrating {
+		c.failEndpoint(serverconn.endpoint)
+	}
+	loggo.Info("useServer close %s %s", serverconn.endpoint.Addr, serverconn.conn.Info())
 
 	return nil
 }
 
-func (c *Client) login(index int, sendch *common.Channel) {
+// 这个隧道登录成功的主通道，没有返回nil
+func (c *Client) getServerConn(index int) *ServerConn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	sc := c.serverconn[index]
+	if sc == nil || !sc.established.Load() {
+		return nil
+	}
+	return sc
+}
+
+func (c *Client) getRetired(index int) *ServerConn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.retired[index]
+}
+
+// 登录成功的主通道，包括收到GOAWAY还在等连接结束的旧的
+func (c *Client) serverConns() []*ServerConn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var ret []*ServerConn
+	for _, sc := range c.serverconn {
+		if sc != nil && sc.established.Load() {
+			ret = append(ret, sc)
+		}
+	}
+	for _, sc := range c.retired {
+		if sc != nil {
+			ret = append(ret, sc)
+		}
+	}
+	return ret
+}
+
+func (c *Client) login(index int, sendch *common.Channel, serverconn *ServerConn) {
 	f := &ProxyFrame{}
 	f.Type = FRAME_TYPE_LOGIN
 	f.LoginFrame = &LoginFrame{}
@@ -199,10 +406,19 @@ func (c *Client) login(index int, sendch *common.Channel) {
 	}
 	f.LoginFrame.Name = c.name + "_" + strconv.Itoa(index)
 	f.LoginFrame.Key = c.config.Key
+	f.LoginFrame.Secret = c.config.Secret
+	f.LoginFrame.Exit = c.config.Exit
+	f.LoginFrame.Allowexit = c.config.AllowExit
+	f.LoginFrame.Exitsecret = c.config.ExitSecret
+	f.LoginFrame.Proxyprotocol = c.config.ProxyProtocol
+	if len(c.config.Group) > 0 {
+		f.LoginFrame.Group = c.config.Group + "_" + strconv.Itoa(index)
+		f.LoginFrame.Balance = c.config.GroupBalance
+	}
 
 	sendch.Write(f)
 
-	loggo.Info("start login %d %s %s", index, c.server, f.LoginFrame.String())
+	loggo.Info("start login %d %s %s", index, serverconn.endpoint.Addr, f.LoginFrame.String())
 }
 
 func (c *Client) process(wg *thread.Group, index int, sendch *common.Channel, recvch *common.Channel, serverconn *ServerConn, pongflag *int32, pongtime *int64) error {
@@ -225,6 +441,7 @@ func (c *Client) process(wg *thread.Group, index int, sendch *common.Channel, re
 
 		case FRAME_TYPE_PONG:
 			processPong(f, sendch, &serverconn.ProxyConn, c.config.ShowPing)
+			serverconn.endpoint.updateRtt(serverconn.getRtt())
 
 		case FRAME_TYPE_DATA:
 			c.processData(f, serverconn)
@@ -237,6 +454,9 @@ func (c *Client) process(wg *thread.Group, index int, sendch *common.Channel, re
 
 		case FRAME_TYPE_CLOSE:
 			c.processClose(f, serverconn)
+
+		case FRAME_TYPE_GOAWAY:
+			c.processGoaway(wg, index, f, serverconn)
 		}
 	}
 	loggo.Info("process end %s", serverconn.conn.Info())
@@ -245,20 +465,35 @@ func (c *Client) process(wg *thread.Group, index int, sendch *common.Channel, re
 
 func (c *Client) processLoginRsp(wg *thread.Group, index int, f *ProxyFrame, sendch *common.Channel, serverconn *ServerConn) {
 	if !f.LoginRspFrame.Ret {
-		serverconn.needclose = true
-		loggo.Error("processLoginRsp fail %s %s", c.server, f.LoginRspFrame.Msg)
+		serverconn.needclose.Store(true)
+		metricsLoginFailed()
+		loggo.Error("processLoginRsp fail %s %s", serverconn.endpoint.Addr, f.LoginRspFrame.Msg)
 		return
 	}
 
-	loggo.Info("processLoginRsp ok %s", c.server)
+	loggo.Info("processLoginRsp ok %s", serverconn.endpoint.Addr)
+
+	if c.isDraining() {
+		serverconn.needclose.Store(true)
+		loggo.Info("processLoginRsp client shutdown %s", serverconn.endpoint.Addr)
+		return
+	}
+
+	// 旧主通道的本地监听让给新的
+	if old := c.getRetired(index); old != nil && old.input != nil {
+		old.input.Close()
+	}
 
 	err := c.iniService(wg, index, serverconn)
 	if err != nil {
-		loggo.Error("processLoginRsp iniService fail %s %s", c.server, err)
+		loggo.Error("processLoginRsp iniService fail %s %s", serverconn.endpoint.Addr, err)
 		return
 	}
 
-	serverconn.established = true
+	c.lock.Lock()
+	serverconn.established.Store(true)
+	c.lock.Unlock()
+	c.traffic.online(c.name+"_"+strconv.Itoa(index), &serverconn.ProxyConn)
 }
 
 func (c *Client) iniService(wg *thread.Group, index int, serverConn *ServerConn) error {
@@ -293,6 +528,36 @@ func (c *Client) iniService(wg *thread.Group, index int, serverConn *ServerConn)
 			return err
 		}
 		serverConn.input = input
+	case CLIENT_TYPE_HTTP_PROXY:
+		input, err := NewHttpProxyInputer(wg, c.proxyproto[index].String(), c.fromaddr[index], c.clienttype, c.config, &serverConn.ProxyConn)
+		if err != nil {
+			return err
+		}
+		serverConn.input = input
+	case CLIENT_TYPE_REVERSE_HTTP_PROXY:
+		output, err := NewOutputer(wg, c.proxyproto[index].String(), c.clienttype, c.config, &serverConn.ProxyConn)
+		if err != nil {
+			return err
+		}
+		serverConn.output = output
+	case CLIENT_TYPE_TRANSPARENT:
+		input, err := NewTransparentInputer(wg, c.proxyproto[index].String(), c.fromaddr[index], c.clienttype, c.config, &serverConn.ProxyConn)
+		if err != nil {
+			return err
+		}
+		serverConn.input = input
+	case CLIENT_TYPE_SECRET:
+		output, err := NewOutputer(wg, c.proxyproto[index].String(), c.clienttype, c.config, &serverConn.ProxyConn)
+		if err != nil {
+			return err
+		}
+		serverConn.output = output
+	case CLIENT_TYPE_SECRET_VISITOR:
+		input, err := NewInputer(wg, c.proxyproto[index].String(), c.fromaddr[index], c.clienttype, c.config, &serverConn.ProxyConn, c.toaddr[index])
+		if err != nil {
+			return err
+		}
+		serverConn.input = input
 	default:
 		return errors.New("error CLIENT_TYPE " + strconv.Itoa(int(c.clienttype)))
 	}
@@ -308,7 +573,9 @@ func (c *Client) processData(f *ProxyFrame, serverconn *ServerConn) {
 }
 
 func (c *Client) processOpen(f *ProxyFrame, serverconn *ServerConn) {
-	if serverconn.output != nil {
+	if c.isDraining() {
+		rejectOpen(f, &serverconn.ProxyConn, "client shutdown")
+	} else if serverconn.output != nil {
 		serverconn.output.processOpenFrame(f)
 	}
 }
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/esrrhs/gohome/network"
+	"gopkg.in/yaml.v3"
+)
+
+// -config 配置文件，顶层的设置是所有隧道的默认值，每个隧道可以单独覆盖
+type FileConfig struct {
+	Type     string // server client
+	Loglevel string
+	Nolog    bool
+	Noprint  bool
+	Profile  int
+	Metrics  string     // /metrics的监听地址
+	Listen   []Endpoint // server监听
+	Config   *Config
+	Tunnels  []*FileTunnel
+}
+
+type FileTunnel struct {
+	Name       string
+	Clienttype string // CLIENT_TYPE的名字，NewMultiClient用
+	Proxyproto string
+	Fromaddr   string
+	Toaddr     string
+	Servers    []Endpoint
+	Config     *Config
+	Line       int
+}
+
+type fileEndpoint struct {
+	Proto string `yaml:"proto"`
+	Addr  string `yaml:"addr"`
+}
+
+type fileTunnelRaw struct {
+	Name       string         `yaml:"name"`
+	Type       string         `yaml:"type"`
+	Proxyproto string         `yaml:"proxyproto"`
+	Fromaddr   string         `yaml:"fromaddr"`
+	Toaddr     string         `yaml:"toaddr"`
+	Servers    []fileEndpoint `yaml:"servers"`
+	Config     `yaml:",inline"`
+}
+
+type fileConfigRaw struct {
+	Type     string          `yaml:"type"`
+	Loglevel string          `yaml:"loglevel"`
+	Nolog    bool            `yaml:"nolog"`
+	Noprint  bool            `yaml:"noprint"`
+	Profile  int             `yaml:"profile"`
+	Metrics  string          `yaml:"metrics"`
+	Listen   []fileEndpoint  `yaml:"listen"`
+	Servers  []fileEndpoint  `yaml:"servers"`
+	Tunnels  []fileTunnelRaw `yaml:"tunnels"`
+	Config   `yaml:",inline"`
+}
+
+type fileError struct {
+	filename string
+	line     int
+	msg      string
+}
+
+func (e *fileError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.filename, e.line, e.msg)
+}
+
+var fileYamlLine = regexp.MustCompile(`^line (\d+): (.*?)( in type \S+)?$`)
+
+// yaml的错误是 "yaml: line 3: xxx" 的格式，转成和fileError一样的 "file:3: xxx"
+func fileYamlError(filename string, err error) error {
+	var msgs []string
+	if te, ok := err.(*yaml.TypeError); ok {
+		msgs = te.Errors
+	} else {
+		msgs = []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+	for i, msg := range msgs {
+		m := fileYamlLine.FindStringSubmatch(msg)
+		if m != nil {
+			msgs[i] = filename + ":" + m[1] + ": " + m[2]
+		} else {
+			msgs[i] = filename + ": " + msg
+		}
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// 找mapping里key所在的行，没有就用mapping自己的行
+func fileNodeLine(n *yaml.Node, key string) int {
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == key {
+				return n.Content[i].Line
+			}
+		}
+	}
+	return n.Line
+}
+
+func fileNodeValue(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == key {
+				return n.Content[i+1]
+			}
+		}
+	}
+	return nil
+}
+
+func fileEndpoints(raw []fileEndpoint, n *yaml.Node, filename string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	for i, e := range raw {
+		line := n.Line
+		if i < len(n.Content) {
+			line = n.Content[i].Line
+		}
+		if len(e.Proto) <= 0 {
+			e.Proto = "tcp"
+		}
+		if !network.HasReliableProto(e.Proto) {
+			return nil, &fileError{filename, line, "proto must be " + fmt.Sprintf("%v", network.SupportReliableProtos())}
+		}
+		if len(e.Addr) <= 0 {
+			return nil, &fileError{filename, line, "no addr"}
+		}
+		endpoints = append(endpoints, Endpoint{Proto: e.Proto, Addr: e.Addr})
+	}
+	return endpoints, nil
+}
+
+func LoadConfigFile(filename string) (*FileConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigFile(filename, data)
+}
+
+func parseConfigFile(filename string, data []byte) (*FileConfig, error) {
+	// 先严格解析一遍，拼错的字段和类型不对都带行号报出来
+	var raw fileConfigRaw
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&raw)
+	if err == io.EOF {
+		return nil, errors.New(filename + ": empty config")
+	}
+	if err != nil {
+		return nil, fileYamlError(filename, err)
+	}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fileYamlError(filename, err)
+	}
+	root := doc.Content[0]
+
+	// 没写的字段保持默认值
+	config := DefaultConfig()
+	err = root.Decode(config)
+	if err != nil {
+		return nil, fileYamlError(filename, err)
+	}
+
+	fc := &FileConfig{
+		Type:     raw.Type,
+		Loglevel: raw.Loglevel,
+		Nolog:    raw.Nolog,
+		Noprint:  raw.Noprint,
+		Profile:  raw.Profile,
+		Metrics:  raw.Metrics,
+		Config:   config,
+	}
+
+	if fc.Type == "server" {
+		if len(raw.Servers) > 0 || len(raw.Tunnels) > 0 {
+			return nil, &fileError{filename, fileNodeLine(root, "tunnels"), "server has no servers or tunnels"}
+		}
+		if len(raw.Listen) <= 0 {
+			return nil, &fileError{filename, root.Line, "server need listen"}
+		}
+		fc.Listen, err = fileEndpoints(raw.Listen, fileNodeValue(root, "listen"), filename)
+		if err != nil {
+			return nil, err
+		}
+		err = checkGroupBalance(config.GroupBalance)
+		if err != nil {
+			return nil, &fileError{filename, fileNodeLine(root, "group-balance"), err.Error()}
+		}
+		return fc, nil
+	}
+
+	if fc.Type != "client" {
+		return nil, &fileError{filename, fileNodeLine(root, "type"), "type must be server/client"}
+	}
+	if len(raw.Listen) > 0 {
+		return nil, &fileError{filename, fileNodeLine(root, "listen"), "client has no listen"}
+	}
+	var servers []Endpoint
+	if len(raw.Servers) > 0 {
+		servers, err = fileEndpoints(raw.Servers, fileNodeValue(root, "servers"), filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(raw.Tunnels) <= 0 {
+		return nil, &fileError{filename, root.Line, "client need tunnels"}
+	}
+
+	tunnelsNode := fileNodeValue(root, "tunnels")
+	names := make(map[string]int)
+	for i, t := range raw.Tunnels {
+		n := tunnelsNode.Content[i]
+
+		tunnel, err := parseFileTunnel(filename, &t, n, config, servers)
+		if err != nil {
+			return nil, err
+		}
+		if line, ok := names[tunnel.Name]; ok {
+			return nil, &fileError{filename, fileNodeLine(n, "name"), fmt.Sprintf("tunnel %s already defined at line %d", tunnel.Name, line)}
+		}
+		names[tunnel.Name] = fileNodeLine(n, "name")
+
+		fc.Tunnels = append(fc.Tunnels, tunnel)
+	}
+
+	return fc, nil
+}
+
+func parseFileTunnel(filename string, t *fileTunnelRaw, n *yaml.Node, base *Config, servers []Endpoint) (*FileTunnel, error) {
+	if len(t.Name) <= 0 {
+		return nil, &fileError{filename, n.Line, "tunnel need name"}
+	}
+
+	clienttypestr := strings.ToUpper(strings.Replace(t.Type, "_client", "", -1))
+	clienttype, ok := CLIENT_TYPE_value[clienttypestr]
+	if !ok || len(t.Type) <= 0 || !strings.HasSuffix(t.Type, "_client") {
+		return nil, &fileError{filename, fileNodeLine(n, "type"), "error tunnel type " + t.Type}
+	}
+
+	if len(t.Proxyproto) <= 0 {
+		t.Proxyproto = "tcp"
+	}
+	if !network.HasProto(t.Proxyproto) {
+		return nil, &fileError{filename, fileNodeLine(n, "proxyproto"), "proxyproto must be " + fmt.Sprintf("%v", network.SupportProtos())}
+	}
+
+	if len(t.Fromaddr) <= 0 {
+		return nil, &fileError{filename, n.Line, "tunnel " + t.Name + " need fromaddr"}
+	}
+	var toaddr []string
+	switch CLIENT_TYPE(clienttype) {
+	case CLIENT_TYPE_PROXY, CLIENT_TYPE_REVERSE_PROXY, CLIENT_TYPE_SECRET, CLIENT_TYPE_SECRET_VISITOR:
+		if len(t.Toaddr) <= 0 {
+			return nil, &fileError{filename, n.Line, "tunnel " + t.Name + " need toaddr"}
+		}
+		toaddr = []string{t.Toaddr}
+	default:
+		if len(t.Toaddr) > 0 {
+			return nil, &fileError{filename, fileNodeLine(n, "toaddr"), "tunnel " + t.Name + " " + t.Type + " has no toaddr"}
+		}
+	}
+
+	if len(t.Servers) > 0 {
+		var err error
+		servers, err = fileEndpoints(t.Servers, fileNodeValue(n, "servers"), filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(servers) <= 0 {
+		return nil, &fileError{filename, n.Line, "tunnel " + t.Name + " need servers"}
+	}
+
+	// 在顶层设置上覆盖隧道自己的设置
+	config := *base
+	err := n.Decode(&config)
+	if err != nil {
+		return nil, fileYamlError(filename, err)
+	}
+
+	err = checkClientConfig(&config, servers, CLIENT_TYPE(clienttype), []string{t.Fromaddr}, toaddr)
+	if err != nil {
+		return nil, &fileError{filename, n.Line, "tunnel " + t.Name + " " + err.Error()}
+	}
+
+	return &FileTunnel{
+		Name:       t.Name,
+		Clienttype: clienttypestr,
+		Proxyproto: t.Proxyproto,
+		Fromaddr:   t.Fromaddr,
+		Toaddr:     t.Toaddr,
+		Servers:    servers,
+		Config:     &config,
+		Line:       n.Line,
+	}, nil
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test0016ConfigFile(t *testing.T) {
+	fc, err := parseConfigFile("client.yml", []byte(`
+type: client
+key: abc
+compress: 0
+servers:
+  - addr: www.server.com:8888
+  - proto: kcp
+    addr: www.server.com:8889
+tunnels:
+  - name: ssh
+    type: proxy_client
+    fromaddr: :8080
+    toaddr: :22
+  - name: web
+    type: reverse_proxy_client
+    proxyproto: tcp
+    fromaddr: :8081
+    toaddr: :80
+    compress: 256
+    conn-timeout: 30
+    proxy-protocol: v2
+    servers:
+      - addr: backup.server.com:8888
+  - name: socks
+    type: socks5_client
+    fromaddr: :1080
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.Type != "client" || len(fc.Tunnels) != 3 {
+		t.Fatal("client tunnels error", fc.Type, len(fc.Tunnels))
+	}
+
+	ssh := fc.Tunnels[0]
+	if ssh.Clienttype != "PROXY" || ssh.Proxyproto != "tcp" || ssh.Config.Key != "abc" || ssh.Config.Compress != 0 ||
+		ssh.Config.ConnTimeout != DefaultConfig().ConnTimeout || len(ssh.Servers) != 2 || ssh.Servers[0].Proto != "tcp" {
+		t.Fatal("ssh tunnel error", ssh, ssh.Config)
+	}
+
+	// 隧道自己的设置不影响别的隧道
+	web := fc.Tunnels[1]
+	if web.Clienttype != "REVERSE_PROXY" || web.Config.Key != "abc" || web.Config.Compress != 256 || web.Config.ConnTimeout != 30 ||
+		web.Config.ProxyProtocol != PROXY_PROTOCOL_V2 || len(web.Servers) != 1 || web.Servers[0].Addr != "backup.server.com:8888" {
+		t.Fatal("web tunnel error", web, web.Config)
+	}
+	if fc.Tunnels[2].Clienttype != "SOCKS5" || len(fc.Tunnels[2].Toaddr) != 0 {
+		t.Fatal("socks tunnel error", fc.Tunnels[2])
+	}
+
+	fc, err = parseConfigFile("server.yml", []byte(`
+type: server
+maxclient: 10
+vhost-http: :80
+listen:
+  - addr: :8888
+  - proto: kcp
+    addr: :8888
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Listen) != 2 || fc.Listen[1].Proto != "kcp" || fc.Config.MaxClient != 10 || fc.Config.VhostHttp != ":80" {
+		t.Fatal("server error", fc.Listen, fc.Config)
+	}
+
+	// 错误都要带上文件名和行号
+	cases := []struct {
+		data   string
+		expect string
+	}{
+		{"type: client\nservers:\n  - addr: a:1\ntunnels:\n  - name: a\n    type: proxy_client\n    fromadr: :1\n", "client.yml:7: field fromadr not found"},
+		{"type: client\nconn-timeout: abc\n", "client.yml:2: cannot unmarshal"},
+		{"type: client\nservers:\n  - addr: a:1\ntunnels:\n  - name: a\n    type: proxy_client\n    fromaddr: :1\n", "client.yml:5: tunnel a need toaddr"},
+		{"type: client\nservers:\n  - addr: a:1\ntunnels:\n  - name: a\n    type: socks5_client\n    fromaddr: :1\n  - name: a\n    type: socks5_client\n    fromaddr: :2\n", "client.yml:8: tunnel a already defined at line 5"},
+		{"type: client\nservers:\n  - addr: a:1\ntunnels:\n  - name: a\n    type: tcp_client\n    fromaddr: :1\n", "client.yml:6: error tunnel type tcp_client"},
+		{"type: client\nservers:\n  - addr: a:1\ntunnels:\n  - name: a\n    type: socks5_client\n    fromaddr: :1\n    proxy-protocol: v3\n", "client.yml:5: tunnel a error proxy protocol v3"},
+		{"type: client\ntunnels:\n  - name: a\n    type: socks5_client\n    fromaddr: :1\n", "client.yml:3: tunnel a need servers"},
+		{"type: client\nservers:\n  - proto: udp\n    addr: a:1\n", "client.yml:3: proto must be"},
+		{"type: server\n", "client.yml:1: server need listen"},
+		{"type: sever\n", "client.yml:1: type must be server/client"},
+		{"", "client.yml: empty config"},
+	}
+	for _, c := range cases {
+		_, err := parseConfigFile("client.yml", []byte(c.data))
+		if err == nil || !strings.HasPrefix(err.Error(), c.expect) {
+			t.Fatal("config error not match", c.expect, err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/network"
+)
+
+type Endpoint struct {
+	Proto string
+	Addr  string
+}
+
+type endpoint struct {
+	Endpoint
+	conn  network.Conn
+	rtt   int64 // 平滑后的rtt，0表示还未测量
+	alive int32
+}
+
+func (e *endpoint) updateRtt(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	old := atomic.LoadInt64(&e.rtt)
+	if old == 0 {
+		atomic.StoreInt64(&e.rtt, int64(rtt))
+	} else {
+		atomic.StoreInt64(&e.rtt, (old*7+int64(rtt))/8)
+	}
+	atomic.StoreInt32(&e.alive, 1)
+}
+
+func (e *endpoint) getRtt() time.Duration {
+	return time.Duration(atomic.LoadInt64(&e.rtt))
+}
+
+func (e *endpoint) isAlive() bool {
+	return atomic.LoadInt32(&e.alive) > 0
+}
+
+// rtt的测量有误差，后面的服务器要明显快才排到前面，差不多时保持配置的顺序，未测量的排在已测量的后面
+func (e *endpoint) fasterThan(other *endpoint) bool {
+	rtt := e.getRtt()
+	ortt := other.getRtt()
+	if rtt == 0 {
+		return false
+	}
+	return ortt == 0 || rtt < ortt*4/5
+}
+
+func (c *Client) pickEndpoint() *endpoint {
+	var best *endpoint
+	for _, ep := range c.endpoints {
+		if !ep.isAlive() {
+			continue
+		}
+		if best == nil || ep.fasterThan(best) {
+			best = ep
+		}
+	}
+	if best == nil {
+		// 全部不可用时按顺序轮流重试
+		n := atomic.AddInt32(&c.retry, 1)
+		best = c.endpoints[int(n)%len(c.endpoints)]
+	}
+	return best
+}
+
+func (c *Client) failEndpoint(ep *endpoint) {
+	if atomic.SwapInt32(&ep.alive, 0) > 0 {
+		loggo.Info("failEndpoint %s %s", ep.Proto, ep.Addr)
+	}
+}
+
+func (c *Client) probeEndpoints() error {
+	loggo.Info("probeEndpoints start %d", len(c.endpoints))
+
+	ticker := time.NewTicker(time.Duration(c.config.ProbeInter) * time.Second)
+	defer ticker.Stop()
+
+	exit := false
+	for !exit {
+		select {
+		case <-c.wg.Done():
+			exit = true
+			break
+
+		case <-ticker.C:
+			inuse := make(map[*endpoint]bool)
+			c.lock.Lock()
+			for _, sc := range c.serverconn {
+				if sc != nil {
+					inuse[sc.endpoint] = true
+				}
+			}
+			c.lock.Unlock()
+
+			for _, ep := range c.endpoints {
+				if inuse[ep] {
+					continue
+				}
+				rtt, err := c.probe(ep)
+				if err != nil {
+					loggo.Info("probeEndpoints fail %s %s %s", ep.Proto, ep.Addr, err.Error())
+					c.failEndpoint(ep)
+					continue
+				}
+				ep.updateRtt(rtt)
+				if c.config.ShowPing {
+					loggo.Info("probeEndpoints ok %s %s %s", ep.Proto, ep.Addr, rtt.String())
+				}
+			}
+
+			c.checkPreferEndpoint()
+		}
+	}
+
+	loggo.Info("probeEndpoints end")
+	return nil
+}
+
+// 当前连接的不是最优服务器时，比如前面的服务器恢复了，在没有活跃连接的时候切换回去
+func (c *Client) checkPreferEndpoint() {
+	best := c.pickEndpoint()
+	if !best.isAlive() {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for index, sc := range c.serverconn {
+		if sc == nil || !sc.established.Load() || sc.endpoint == best {
+			continue
+		}
+		cur := sc.endpoint
+		if sc.input != nil && sc.input.sonnySize() > 0 {
+			continue
+		}
+		if sc.output != nil && sc.output.sonnySize() > 0 {
+			continue
+		}
+		loggo.Info("checkPreferEndpoint switch %d %s %s -> %s %s", index, cur.Proto, cur.Addr, best.Proto, best.Addr)
+		sc.migrating = true
+		sc.needclose.Store(true)
+	}
+}
+
+func (c *Client) probe(ep *endpoint) (time.Duration, error) {
+	cn, err := network.NewConn(ep.Proto)
+	if cn == nil {
+		return 0, err
+	}
+
+	setCongestion(cn, c.config)
+
+	var lock sync.Mutex
+	var conn network.Conn
+	closed := false
+
+	result := make(chan error, 1)
+	var rtt time.Duration
+	go func() {
+		defer common.CrashLog()
+		cc, err := dialServer(cn, ep.Addr, c.config)
+		if err != nil {
+			result <- err
+			return
+		}
+		lock.Lock()
+		if closed {
+			lock.Unlock()
+			cc.Close()
+			result <- errors.New("closed")
+			return
+		}
+		conn = cc
+		lock.Unlock()
+		rtt, err = pingPong(cc, c.config)
+		result <- err
+	}()
+
+	timer := time.NewTimer(time.Duration(c.config.ConnectTimeout) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case err = <-result:
+	case <-timer.C:
+		err = errors.New("probe timeout")
+	case <-c.wg.Done():
+		err = errors.New("exit")
+	}
+
+	lock.Lock()
+	closed = true
+	cn.Close()
+	if conn != nil {
+		conn.Close()
+	}
+	lock.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	return rtt, nil
+}
+
+func pingPong(conn network.Conn, config *Config) (time.Duration, error) {
+	f := &ProxyFrame{}
+	f.Type = FRAME_TYPE_PING
+	f.PingFrame = &PingFrame{}
+	f.PingFrame.Time = time.Now().UnixNano()
+
+	mb, err := MarshalSrpFrame(f, 0, config.Encrypt)
+	if err != nil {
+		return 0, err
+	}
+
+	bs := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bs, uint32(len(mb)))
+	if _, err := conn.Write(bs); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(mb); err != nil {
+		return 0, err
+	}
+
+	ds := make([]byte, config.MaxMsgSize+MAX_PROTO_PACK_SIZE)
+	for {
+		if _, err := io.ReadFull(conn, bs); err != nil {
+			return 0, err
+		}
+		msglen := binary.LittleEndian.Uint32(bs)
+		if msglen > uint32(config.MaxMsgSize)+MAX_PROTO_PACK_SIZE || msglen <= 0 {
+			return 0, errors.New("msg len fail " + strconv.Itoa(int(msglen)))
+		}
+		if _, err := io.ReadFull(conn, ds[0:msglen]); err != nil {
+			return 0, err
+		}
+		rf, err := UnmarshalSrpFrame(ds[0:msglen], config.Encrypt)
+		if err != nil {
+			return 0, err
+		}
+		if rf.Type == FRAME_TYPE_PONG {
+			return time.Duration(time.Now().UnixNano() - rf.PongFrame.Time), nil
+		}
+	}
+}
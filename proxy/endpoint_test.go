@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func Test0003ClientFailover(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	echo := startEcho(t, "tcp", "127.0.0.1:32002")
+	defer echo.Close()
+
+	// 本地连接关掉以后等不活跃超时才结束，有连接时不会切回去
+	config := DefaultConfig()
+	config.ProbeInter = 1
+	config.EstablishedTimeout = 2
+	config.ConnTimeout = 2
+
+	s1, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:32000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := NewServer(config, []string{"kcp"}, []string{"127.0.0.1:32001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	endpoints := []Endpoint{{Proto: "tcp", Addr: "127.0.0.1:32000"}, {Proto: "kcp", Addr: "127.0.0.1:32001"}}
+	c, err := NewMultiClient(config, endpoints, "test", "PROXY", []string{"tcp"}, []string{"127.0.0.1:32003"}, []string{"127.0.0.1:32002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := checkEcho("tcp", "127.0.0.1:32003", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if sc := c.getServerConn(0); sc == nil || sc.endpoint.Proto != "tcp" {
+		t.Fatal("not use first endpoint")
+	}
+
+	s1.Close()
+
+	begin := time.Now()
+	for time.Since(begin) < 10*time.Second {
+		if sc := c.getServerConn(0); sc != nil && sc.endpoint.Proto == "kcp" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := checkEcho("tcp", "127.0.0.1:32003", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if sc := c.getServerConn(0); sc == nil || sc.endpoint.Proto != "kcp" {
+		t.Fatal("not failover to second endpoint")
+	}
+
+	// 第一个恢复以后，没有连接的时候切回去
+	s1, err = NewServer(config, []string{"tcp"}, []string{"127.0.0.1:32000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+
+	begin = time.Now()
+	for time.Since(begin) < 20*time.Second {
+		if sc := c.getServerConn(0); sc != nil && sc.endpoint.Proto == "tcp" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if sc := c.getServerConn(0); sc == nil || sc.endpoint.Proto != "tcp" {
+		t.Fatal("not move back to first endpoint")
+	}
+	if err := checkEcho("tcp", "127.0.0.1:32003", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
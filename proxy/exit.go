@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"crypto/subtle"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// socks5 client可以指定另一个在线的client做出口，OPEN转到出口client的主通道，由它的Outputer去连目标
+func isExitType(clienttype CLIENT_TYPE) bool {
+	return clienttype == CLIENT_TYPE_REVERSE_SOCKS5 || clienttype == CLIENT_TYPE_REVERSE_HTTP_PROXY
+}
+
+func (s *Server) findExit(name string) *ClientConn {
+	v, ok := s.clients.Load(name)
+	if !ok {
+		return nil
+	}
+	clientconn := v.(*ClientConn)
+	// 只有登录时声明了allow-exit并且带了密钥的client才能当出口
+	if !clientconn.established.Load() || !isExitType(clientconn.clienttype) || !clientconn.allowexit || len(clientconn.exitsecret) <= 0 {
+		return nil
+	}
+	return clientconn
+}
+
+func (s *Server) openExit(f *ProxyFrame, visitor *ClientConn) {
+	id := f.OpenFrame.Id
+
+	rf := &ProxyFrame{}
+	rf.Type = FRAME_TYPE_OPENRSP
+	rf.OpenRspFrame = &OpenConnRspFrame{}
+	rf.OpenRspFrame.Id = id
+	rf.OpenRspFrame.Ret = false
+
+	if !visitor.established.Load() {
+		rf.OpenRspFrame.Msg = "not login"
+		visitor.sendch.Write(rf)
+		loggo.Error("openExit not login %s %s", id, visitor.conn.Info())
+		return
+	}
+
+	provider := s.findExit(visitor.exit)
+	if provider == nil {
+		rf.OpenRspFrame.Msg = "no exit " + visitor.exit
+		visitor.sendch.Write(rf)
+		loggo.Error("openExit no exit %s %s %s", id, visitor.exit, visitor.conn.Info())
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(provider.exitsecret), []byte(visitor.exitsecret)) != 1 {
+		rf.OpenRspFrame.Msg = "exit secret error"
+		visitor.sendch.Write(rf)
+		loggo.Error("openExit exit secret error %s %s %s", id, visitor.exit, visitor.conn.Info())
+		return
+	}
+
+	if !s.openRelay(f, visitor, provider) {
+		rf.OpenRspFrame.Msg = "relay fail"
+		visitor.sendch.Write(rf)
+		loggo.Error("openExit relay fail %s %s %s", id, visitor.exit, visitor.conn.Info())
+		return
+	}
+
+	loggo.Info("openExit %s %s %s -> %s", id, f.OpenFrame.Toaddr, visitor.conn.Info(), provider.conn.Info())
+}
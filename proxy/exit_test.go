@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func Test0013SocksExit(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	echo := startUdpEcho(t, "127.0.0.1:33010")
+	defer echo.Close()
+
+	tcpecho := startEcho(t, "tcp", "127.0.0.1:33010")
+	defer tcpecho.Close()
+
+	config := DefaultConfig()
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:33000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := NewClient(&Config{Exit: "test_exit"}, "tcp", "127.0.0.1:33000", "test_exit_proxy", "PROXY", []string{"tcp"}, []string{"127.0.0.1:33003"}, []string{"127.0.0.1:33010"}); err == nil {
+		t.Fatal("exit only support socks5")
+	}
+
+	if _, err := NewClient(&Config{Exit: "test_exit_0"}, "tcp", "127.0.0.1:33000", "test_exit_socks5", "SOCKS5", []string{"tcp"}, []string{"127.0.0.1:33002"}, nil); err == nil {
+		t.Fatal("exit need exit secret")
+	}
+
+	if _, err := NewClient(&Config{AllowExit: true, ExitSecret: "123"}, "tcp", "127.0.0.1:33000", "test_exit", "REVERSE_PROXY", []string{"tcp"}, []string{"127.0.0.1:33001"}, []string{"127.0.0.1:33010"}); err == nil {
+		t.Fatal("allow exit only support reverse socks5 and reverse http proxy")
+	}
+
+	// 没有声明allow-exit的client不能当出口
+	nc, err := NewClient(config, "tcp", "127.0.0.1:33000", "test_noexit", "REVERSE_SOCKS5", []string{"tcp"}, []string{"127.0.0.1:33004"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	nconfig := DefaultConfig()
+	nconfig.Exit = "test_noexit_0"
+	nconfig.ExitSecret = "123"
+	n, err := NewClient(nconfig, "tcp", "127.0.0.1:33000", "test_noexit_socks5", "SOCKS5", []string{"tcp"}, []string{"127.0.0.1:33005"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	econfig := DefaultConfig()
+	econfig.AllowExit = true
+	econfig.ExitSecret = "123"
+	ec, err := NewClient(econfig, "tcp", "127.0.0.1:33000", "test_exit", "REVERSE_SOCKS5", []string{"tcp"}, []string{"127.0.0.1:33001"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ec.Close()
+
+	// 密钥不对
+	wconfig := DefaultConfig()
+	wconfig.Exit = "test_exit_0"
+	wconfig.ExitSecret = "456"
+	w, err := NewClient(wconfig, "tcp", "127.0.0.1:33000", "test_exit_wrong", "SOCKS5", []string{"tcp"}, []string{"127.0.0.1:33006"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	cconfig := DefaultConfig()
+	cconfig.Exit = "test_exit_0"
+	cconfig.ExitSecret = "123"
+	c, err := NewClient(cconfig, "tcp", "127.0.0.1:33000", "test_exit_socks5", "SOCKS5", []string{"tcp"}, []string{"127.0.0.1:33002"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var lasterr error
+	begin := time.Now()
+	for time.Since(begin) < 10*time.Second {
+		lasterr = trySocks5Connect("127.0.0.1:33002", "127.0.0.1:33010")
+		if lasterr == nil {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if lasterr != nil {
+		t.Fatal(lasterr)
+	}
+
+	if err := checkSocks5Udp("127.0.0.1:33002", "127.0.0.1:33010", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 主通道都已经登录上了，这两个都要被拒绝
+	if err := trySocks5Connect("127.0.0.1:33005", "127.0.0.1:33010"); err == nil {
+		t.Fatal("client without allow exit should not be exit")
+	}
+	if err := trySocks5Connect("127.0.0.1:33006", "127.0.0.1:33010"); err == nil {
+		t.Fatal("exit secret error should fail")
+	}
+
+	// 出口client下线之后连不上
+	ec.Close()
+	begin = time.Now()
+	for time.Since(begin) < 10*time.Second {
+		if err := trySocks5Connect("127.0.0.1:33002", "127.0.0.1:33010"); err != nil {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Fatal("socks5 should fail after exit client offline")
+}
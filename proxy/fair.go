@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/thread"
+)
+
+// 按权重分的一份，同一个名字的主通道共用
+type fairFlow struct {
+	name   string
+	weight float64
+	finish float64 // 最后一个包的虚拟结束时间
+	sent   int64
+	waited int64 // 排队等的纳秒
+	refs   int   // 用它的主通道数，减到0从flows里删掉
+	sched  *fairScheduler
+}
+
+type fairWaiter struct {
+	flow   *fairFlow
+	size   int
+	finish float64
+	seq    uint64
+	index  int // 在queue里的位置，放行以后是-1
+	ch     chan struct{}
+}
+
+// 按虚拟结束时间排，一样的先来先走
+type fairQueue []*fairWaiter
+
+func (q fairQueue) Len() int { return len(q) }
+func (q fairQueue) Less(i, j int) bool {
+	if q[i].finish != q[j].finish {
+		return q[i].finish < q[j].finish
+	}
+	return q[i].seq < q[j].seq
+}
+func (q fairQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *fairQueue) Push(x interface{}) {
+	w := x.(*fairWaiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+func (q *fairQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// server发给所有client的数据共用出口带宽，够用时直接发，不够用时按权重排队，权重大的分得多，没人抢时谁都能用满
+type fairScheduler struct {
+	lock   sync.Mutex
+	rate   float64 // 每秒字节，<=0不调度
+	burst  float64
+	tokens float64
+	last   time.Time
+	vtime  float64 // 正在发的包的虚拟结束时间
+	seq    uint64
+	flows  map[string]*fairFlow
+	queue  fairQueue
+	wake   chan struct{}
+}
+
+func newFairScheduler(config *Config) *fairScheduler {
+	s := &fairScheduler{
+		flows: make(map[string]*fairFlow),
+		wake:  make(chan struct{}, 1),
+	}
+	s.reload(config)
+	return s
+}
+
+func fairWeight(config *Config, name string) float64 {
+	weight, ok := config.FairWeights[name]
+	if !ok || weight <= 0 {
+		return 1
+	}
+	return float64(weight)
+}
+
+// 配置里的fair-groups优先，然后是服务组，最后是client自己的名字
+func fairFlowName(config *Config, clientconn *ClientConn) string {
+	if name, ok := config.FairGroups[clientconn.name]; ok {
+		return name
+	}
+	if clientconn.group != nil {
+		return clientconn.group.name
+	}
+	return clientconn.name
+}
+
+func (s *fairScheduler) reload(config *Config) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.refill(time.Now())
+	s.rate = float64(config.Bandwidth) * 1024
+	// 只攒100ms，拥塞时很快就开始排队
+	s.burst = s.rate / 10
+	if s.tokens > s.burst {
+		s.tokens = s.burst
+	}
+	for name, flow := range s.flows {
+		flow.weight = fairWeight(config, name)
+	}
+	s.notify()
+}
+
+func (s *fairScheduler) flow(config *Config, name string) *fairFlow {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	flow, ok := s.flows[name]
+	if !ok {
+		flow = &fairFlow{name: name, weight: fairWeight(config, name), sched: s}
+		s.flows[name] = flow
+	}
+	flow.refs++
+	return flow
+}
+
+// 主通道结束时放掉，没有主通道用的名字不再留着
+func (s *fairScheduler) release(flow *fairFlow) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	flow.refs--
+	if flow.refs <= 0 && s.flows[flow.name] == flow {
+		delete(s.flows, flow.name)
+	}
+}
+
+// 调用时要拿着lock
+func (s *fairScheduler) refill(now time.Time) {
+	if !s.last.IsZero() {
+		s.tokens += now.Sub(s.last).Seconds() * s.rate
+		if s.tokens > s.burst {
+			s.tokens = s.burst
+		}
+	}
+	s.last = now
+}
+
+// 调用时要拿着lock
+func (s *fairScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// 发size个字节之前调用，轮到了才返回
+func (f *fairFlow) acquire(wg *thread.Group, size int) {
+	s := f.sched
+
+	s.lock.Lock()
+	if s.rate <= 0 {
+		s.lock.Unlock()
+		atomic.AddInt64(&f.sent, int64(size))
+		return
+	}
+
+	s.refill(time.Now())
+	start := f.finish
+	if start < s.vtime {
+		start = s.vtime
+	}
+	finish := start + float64(size)/f.weight
+	f.finish = finish
+
+	if len(s.queue) == 0 && s.tokens >= 0 {
+		// 没有拥塞，不用排队
+		s.tokens -= float64(size)
+		s.vtime = finish
+		s.lock.Unlock()
+		atomic.AddInt64(&f.sent, int64(size))
+		return
+	}
+
+	s.seq++
+	w := &fairWaiter{flow: f, size: size, finish: finish, seq: s.seq, ch: make(chan struct{})}
+	heap.Push(&s.queue, w)
+	s.notify()
+	s.lock.Unlock()
+
+	begin := time.Now()
+	select {
+	case <-w.ch:
+	case <-wg.Done():
+		// 不发了就从队列里拿掉，已经放行的还是算发了
+		s.lock.Lock()
+		abandoned := w.index >= 0
+		if abandoned {
+			heap.Remove(&s.queue, w.index)
+			s.notify()
+		}
+		s.lock.Unlock()
+		if abandoned {
+			return
+		}
+	}
+	atomic.AddInt64(&f.waited, int64(time.Since(begin)))
+	atomic.AddInt64(&f.sent, int64(size))
+}
+
+// 令牌够了就按顺序放行排队的包
+func (s *fairScheduler) run(wg *thread.Group) error {
+	loggo.Info("fairScheduler start")
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		wait := time.Duration(-1)
+
+		s.lock.Lock()
+		s.refill(time.Now())
+		for len(s.queue) > 0 {
+			if s.rate > 0 && s.tokens < 0 {
+				wait = time.Duration(-s.tokens / s.rate * float64(time.Second))
+				break
+			}
+			w := heap.Pop(&s.queue).(*fairWaiter)
+			s.tokens -= float64(w.size)
+			s.vtime = w.finish
+			close(w.ch)
+		}
+		s.lock.Unlock()
+
+		if wait < 0 {
+			select {
+			case <-wg.Done():
+				loggo.Info("fairScheduler end")
+				return nil
+			case <-s.wake:
+			}
+			continue
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-wg.Done():
+			loggo.Info("fairScheduler end")
+			return nil
+		case <-s.wake:
+		case <-timer.C:
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+func fairSend(wg *thread.Group, p *ProxyConn, size int) {
+	flow := p.fair.Load()
+	if flow != nil {
+		flow.acquire(wg, size)
+	}
+}
+
+// 调度里每一份的统计
+type FairStats struct {
+	Name      string  `json:"name"`
+	Weight    float64 `json:"weight"`
+	SendBytes int64   `json:"send_bytes"`
+	WaitedMs  int64   `json:"waited_ms"` // 排队等的毫秒
+}
+
+func (s *Server) FairStats() []*FairStats {
+	s.fair.lock.Lock()
+	var ret []*FairStats
+	for _, flow := range s.fair.flows {
+		ret = append(ret, &FairStats{
+			Name:      flow.name,
+			Weight:    flow.weight,
+			SendBytes: atomic.LoadInt64(&flow.sent),
+			WaitedMs:  atomic.LoadInt64(&flow.waited) / int64(time.Millisecond),
+		})
+	}
+	s.fair.lock.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
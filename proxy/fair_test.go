@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/thread"
+)
+
+func Test0025Fair(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	echo := startEcho(t, "tcp", "127.0.0.1:34102")
+	defer echo.Close()
+
+	// 包小一点，按包调度才分得均匀
+	config := DefaultConfig()
+	config.MaxMsgSize = 16 * 1024
+	config.Bandwidth = 512
+	config.FairWeights = map[string]int{"premium": 3}
+	config.FairGroups = map[string]string{"test_fair_p_0": "premium"}
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:34100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cconfig := DefaultConfig()
+	cconfig.MaxMsgSize = 16 * 1024
+	pc, err := NewClient(cconfig, "tcp", "127.0.0.1:34100", "test_fair_p", "PROXY", []string{"tcp"}, []string{"127.0.0.1:34103"}, []string{"127.0.0.1:34102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	bc, err := NewClient(cconfig, "tcp", "127.0.0.1:34100", "test_fair_b", "PROXY", []string{"tcp"}, []string{"127.0.0.1:34104"}, []string{"127.0.0.1:34102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	if err := checkEcho("tcp", "127.0.0.1:34103", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEcho("tcp", "127.0.0.1:34104", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 一起发的时候权重3的分得多，先发完，平分的话另一个这时也差不多发完了
+	before := s.FairStats()
+	if len(before) != 2 {
+		t.Fatal("fair flows error", len(before))
+	}
+	// 随机数据压缩不了，发的字节数才准
+	size := 384 * 1024
+	data := make([]byte, size)
+	rand.Read(data)
+	type result struct {
+		d     time.Duration
+		err   error
+		stats []*FairStats
+	}
+	pr := make(chan result, 1)
+	br := make(chan result, 1)
+	go func() {
+		d, err := echoBulk("127.0.0.1:34103", data)
+		pr <- result{d, err, s.FairStats()}
+	}()
+	go func() {
+		d, err := echoBulk("127.0.0.1:34104", data)
+		br <- result{d, err, s.FairStats()}
+	}()
+	p := <-pr
+	b := <-br
+	if p.err != nil || b.err != nil {
+		t.Fatal(p.err, b.err)
+	}
+	if p.d >= b.d || p.stats[1].SendBytes-before[1].SendBytes > int64(size)*2/3 {
+		t.Fatal("premium not faster", p.d, b.d, p.stats[1].SendBytes-before[1].SendBytes)
+	}
+	// 2*size按512KB/s至少要1.5秒
+	if b.d < time.Second {
+		t.Fatal("bandwidth not limited", b.d)
+	}
+
+	stats := s.FairStats()
+	if len(stats) != 2 || stats[0].Name != "premium" || stats[0].Weight != 3 || stats[0].SendBytes < int64(size) ||
+		stats[1].Name != "test_fair_b_0" || stats[1].Weight != 1 || stats[1].WaitedMs <= 0 {
+		t.Fatal("fair stats error", stats[0], stats[1])
+	}
+
+	// 关掉调度以后不用排队
+	nconfig := *config
+	nconfig.Bandwidth = 0
+	if err := s.Reload(&nconfig, []string{"tcp"}, []string{"127.0.0.1:34100"}); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := echoBulk("127.0.0.1:34104", data); err != nil || d > time.Second {
+		t.Fatal("no bandwidth", d, err)
+	}
+
+	// 主通道都结束了，调度里不再留着
+	pc.Close()
+	bc.Close()
+	begin := time.Now()
+	for len(s.FairStats()) != 0 && time.Since(begin) < 10*time.Second {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if stats := s.FairStats(); len(stats) != 0 {
+		t.Fatal("fair flows not released", len(stats))
+	}
+
+	// 排队的时候连接结束了，从队列里拿掉，也不算发了
+	sched := newFairScheduler(config)
+	flow := sched.flow(config, "test_fair_abandon")
+	wg := thread.NewGroup("test fair", nil, nil)
+	flow.acquire(wg, 1024)
+	wg.Stop()
+	flow.acquire(wg, 1024)
+	if len(sched.queue) != 0 || flow.sent != 1024 {
+		t.Fatal("abandoned waiter error", len(sched.queue), flow.sent)
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/network"
+	"github.com/esrrhs/gohome/thread"
+)
+
+func (c *ClientConn) isGoaway() bool {
+	return atomic.LoadInt32(&c.goaway) != 0
+}
+
+// 告诉client这条主通道不再开新的连接，proto addr不为空时让它连到这个地址
+func (s *Server) sendGoaway(clientconn *ClientConn, msg string, proto string, addr string) {
+	if !atomic.CompareAndSwapInt32(&clientconn.goaway, 0, 1) {
+		return
+	}
+
+	f := &ProxyFrame{}
+	f.Type = FRAME_TYPE_GOAWAY
+	f.GoawayFrame = &GoawayFrame{}
+	f.GoawayFrame.Msg = msg
+	f.GoawayFrame.Proto = proto
+	f.GoawayFrame.Addr = addr
+	clientconn.sendch.Write(f)
+
+	loggo.Info("sendGoaway %s %s %s %s %s", clientconn.key, clientconn.conn.Info(), msg, proto, addr)
+}
+
+// 同名的client重新登录时，发过GOAWAY的旧主通道让位，端口、vhost和secret名字给新的，旧的连接继续在旧的主通道上跑完
+func (s *Server) replaceGoaway(old *ClientConn, clientconn *ClientConn) bool {
+	if !old.isGoaway() {
+		return false
+	}
+	if !s.clients.CompareAndSwap(old.key, old, clientconn) {
+		return false
+	}
+	s.retired.Store(old, true)
+
+	if old.input != nil && old.group == nil {
+		old.input.Close()
+	}
+	if old.vhost != nil {
+		s.vhostRouter(old.vhost.scheme).remove(old.vhost)
+	}
+	if isSecretType(old.clienttype) {
+		s.closeSecret(old)
+	}
+
+	loggo.Info("replaceGoaway %s %s -> %s", old.key, old.conn.Info(), clientconn.conn.Info())
+	return true
+}
+
+// server让这条主通道不再开新的连接，马上连一条新的接替，已有的连接在旧的上面结束
+func (c *Client) processGoaway(wg *thread.Group, index int, f *ProxyFrame, serverconn *ServerConn) {
+	if !atomic.CompareAndSwapInt32(&serverconn.goaway, 0, 1) {
+		return
+	}
+
+	loggo.Info("processGoaway %d %s %s %s %s", index, serverconn.endpoint.Addr, f.GoawayFrame.Msg, f.GoawayFrame.Proto, f.GoawayFrame.Addr)
+
+	var next *endpoint
+	if len(f.GoawayFrame.Addr) > 0 {
+		proto := f.GoawayFrame.Proto
+		if len(proto) <= 0 {
+			proto = serverconn.endpoint.Proto
+		}
+		ep, err := c.goawayEndpoint(proto, f.GoawayFrame.Addr)
+		if err != nil {
+			loggo.Error("processGoaway endpoint fail %s %s %s", proto, f.GoawayFrame.Addr, err)
+		} else {
+			next = ep
+		}
+	} else {
+		// 有别的服务器时优先换过去
+		c.failEndpoint(serverconn.endpoint)
+	}
+
+	c.lock.Lock()
+	serverconn.migrating = true
+	if next != nil {
+		c.next[index] = next
+	}
+	c.retired[index] = serverconn
+	if c.serverconn[index] == serverconn {
+		c.serverconn[index] = nil
+	}
+	c.lock.Unlock()
+
+	wg.Go("Client drainGoaway"+" "+serverconn.conn.Info(), func() error {
+		return c.drainGoaway(wg, index, serverconn)
+	})
+}
+
+// 配置里有的用配置里的，没有的临时建一个，只用这一次
+func (c *Client) goawayEndpoint(proto string, addr string) (*endpoint, error) {
+	for _, ep := range c.endpoints {
+		if ep.Proto == proto && ep.Addr == addr {
+			return ep, nil
+		}
+	}
+
+	cn, err := network.NewConn(proto)
+	if cn == nil {
+		return nil, err
+	}
+
+	setCongestion(cn, c.config)
+
+	return &endpoint{Endpoint: Endpoint{Proto: proto, Addr: addr}, conn: cn, alive: 1}, nil
+}
+
+// 新的主通道接上并且旧的连接都结束了，关掉旧的主通道
+func (c *Client) drainGoaway(wg *thread.Group, index int, serverconn *ServerConn) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wg.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if c.getServerConn(index) == nil {
+			continue
+		}
+		if serverconn.input != nil && serverconn.input.sonnySize() > 0 {
+			continue
+		}
+		if serverconn.output != nil && serverconn.output.sonnySize() > 0 {
+			continue
+		}
+
+		loggo.Info("drainGoaway ok %d %s", index, serverconn.conn.Info())
+		serverconn.needclose.Store(true)
+		return nil
+	}
+}
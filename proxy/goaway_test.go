@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func Test0023Goaway(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	echo := startEcho(t, "tcp", "127.0.0.1:33902")
+	defer echo.Close()
+
+	config := DefaultConfig()
+	config.Admin = "127.0.0.1:33901"
+	config.AdminToken = "abc"
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:33900"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s2, err := NewServer(DefaultConfig(), []string{"tcp"}, []string{"127.0.0.1:33905"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	// 本地连接关掉以后等不活跃超时才结束，checkSonnyActive过了EstablishedTimeout才开始算
+	cconfig := DefaultConfig()
+	cconfig.EstablishedTimeout = 2
+	cconfig.ConnTimeout = 2
+	c, err := NewClient(cconfig, "tcp", "127.0.0.1:33900", "test_goaway", "PROXY", []string{"tcp"}, []string{"127.0.0.1:33903"}, []string{"127.0.0.1:33902"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := checkEcho("tcp", "127.0.0.1:33903", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:33903")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := echoOnce(conn, []byte("hello spp goaway")); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _ := adminRequest("POST", "http://127.0.0.1:33901/api/clients/noclient/goaway", "abc", nil); code != http.StatusNotFound {
+		t.Fatal("goaway no client", code)
+	}
+	if code, _ := adminRequest("POST", "http://127.0.0.1:33901/api/clients/test_goaway_0/goaway?proto=tcp&addr=127.0.0.1:33905", "abc", nil); code != http.StatusOK {
+		t.Fatal("goaway", code)
+	}
+
+	// 新的主通道连到指定的地址，旧的连接还在旧的主通道上
+	begin := time.Now()
+	for time.Since(begin) < 10*time.Second {
+		sc := c.getServerConn(0)
+		if sc != nil && sc.endpoint.Addr == "127.0.0.1:33905" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	sc := c.getServerConn(0)
+	if sc == nil || sc.endpoint.Addr != "127.0.0.1:33905" {
+		t.Fatal("client not move to new server")
+	}
+	if c.getRetired(0) == nil || c.getRetired(0).endpoint.Addr != "127.0.0.1:33900" {
+		t.Fatal("old conn should be draining")
+	}
+	if err := echoOnce(conn, []byte("hello spp goaway drain")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkEcho("tcp", "127.0.0.1:33903", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clients := s2.Clients()
+	if len(clients) != 1 || clients[0].RecvBytes <= 0 {
+		t.Fatal("new stream not on new server", clients)
+	}
+	clients = s.Clients()
+	if len(clients) != 1 || !clients[0].Goaway {
+		t.Fatal("old server client error", clients)
+	}
+
+	// 旧的连接都结束以后关掉旧的主通道
+	conn.Close()
+	begin = time.Now()
+	for c.getRetired(0) != nil && time.Since(begin) < 15*time.Second {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if c.getRetired(0) != nil {
+		t.Fatal("old conn not closed")
+	}
+	begin = time.Now()
+	for len(s.Clients()) != 0 && time.Since(begin) < 5*time.Second {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(s.Clients()) != 0 {
+		t.Fatal("old server client not closed", s.Clients())
+	}
+
+	// 没有指定地址时连回同一个server，顶替旧的登录，端口让给新的
+	rc, err := NewClient(cconfig, "tcp", "127.0.0.1:33900", "test_goaway_r", "REVERSE_PROXY", []string{"tcp"}, []string{"127.0.0.1:33906"}, []string{"127.0.0.1:33902"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	if err := checkEcho("tcp", "127.0.0.1:33906", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	rconn, err := net.Dial("tcp", "127.0.0.1:33906")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rconn.Close()
+	if err := echoOnce(rconn, []byte("hello spp goaway reverse")); err != nil {
+		t.Fatal(err)
+	}
+
+	old := rc.getServerConn(0)
+	if !s.GoawayClient("test_goaway_r_0", "", "") {
+		t.Fatal("goaway reverse")
+	}
+	begin = time.Now()
+	for time.Since(begin) < 10*time.Second {
+		sc := rc.getServerConn(0)
+		if sc != nil && sc != old {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	sc = rc.getServerConn(0)
+	if sc == nil || sc == old {
+		t.Fatal("reverse client not replaced")
+	}
+	if err := echoOnce(rconn, []byte("hello spp goaway reverse drain")); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEcho("tcp", "127.0.0.1:33906", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clients = s.Clients()
+	if len(clients) != 1 || clients[0].Goaway {
+		t.Fatal("reverse client not replaced on server", clients)
+	}
+}
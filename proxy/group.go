@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/thread"
+)
+
+const (
+	GROUP_BALANCE_ROUND_ROBIN = "round_robin"
+	GROUP_BALANCE_LEAST_CONN  = "least_conn"
+)
+
+func checkGroupBalance(balance string) error {
+	if balance != "" && balance != GROUP_BALANCE_ROUND_ROBIN && balance != GROUP_BALANCE_LEAST_CONN {
+		return errors.New("error group balance " + balance)
+	}
+	return nil
+}
+
+type groupMember struct {
+	clientconn *ClientConn
+	conns      int32
+}
+
+// 多个reverse client注册同一个服务组，共用server上的一个Inputer，新连接分给其中一个
+type serviceGroup struct {
+	name       string
+	balance    string
+	proxyproto PROXY_PROTO
+	fromaddr   string
+	wg         *thread.Group
+	input      *Inputer
+
+	lock    sync.RWMutex
+	members []*groupMember
+	next    uint32
+}
+
+func (g *serviceGroup) add(clientconn *ClientConn) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.members = append(g.members, &groupMember{clientconn: clientconn})
+}
+
+func (g *serviceGroup) remove(clientconn *ClientConn) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for i, m := range g.members {
+		if m.clientconn == clientconn {
+			g.members = append(g.members[:i:i], g.members[i+1:]...)
+			break
+		}
+	}
+	return len(g.members)
+}
+
+func (g *serviceGroup) size() int {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return len(g.members)
+}
+
+func (g *serviceGroup) pick() *groupMember {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	if len(g.members) <= 0 {
+		return nil
+	}
+
+	// 发过GOAWAY的成员只在没有别的成员时才用
+	members := g.members
+	var alive []*groupMember
+	for _, m := range g.members {
+		if !m.clientconn.isGoaway() {
+			alive = append(alive, m)
+		}
+	}
+	if len(alive) > 0 {
+		members = alive
+	}
+
+	var member *groupMember
+	if g.balance == GROUP_BALANCE_LEAST_CONN {
+		for _, m := range members {
+			if member == nil || atomic.LoadInt32(&m.conns) < atomic.LoadInt32(&member.conns) {
+				member = m
+			}
+		}
+	} else {
+		index := atomic.AddUint32(&g.next, 1)
+		member = members[int(index)%len(members)]
+	}
+
+	atomic.AddInt32(&member.conns, 1)
+	return member
+}
+
+func (g *serviceGroup) done(member *groupMember) {
+	atomic.AddInt32(&member.conns, -1)
+}
+
+func (s *Server) joinGroup(f *ProxyFrame, clientConn *ClientConn) error {
+	if f.LoginFrame.Clienttype != CLIENT_TYPE_REVERSE_PROXY {
+		return errors.New("group only support reverse proxy")
+	}
+	if isVhostAddr(f.LoginFrame.Fromaddr) {
+		return errors.New("group not support vhost")
+	}
+	err := checkGroupBalance(f.LoginFrame.Balance)
+	if err != nil {
+		return err
+	}
+
+	s.groupLock.Lock()
+	defer s.groupLock.Unlock()
+
+	g, ok := s.groups[f.LoginFrame.Group]
+	if !ok {
+		g = &serviceGroup{
+			name:       f.LoginFrame.Group,
+			balance:    f.LoginFrame.Balance,
+			proxyproto: f.LoginFrame.Proxyproto,
+			fromaddr:   f.LoginFrame.Fromaddr,
+			wg:         thread.NewGroup("Server group"+" "+f.LoginFrame.Group, s.wg, nil),
+		}
+		input, err := NewGroupInputer(g.wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Fromaddr, f.LoginFrame.Clienttype, clientConn.config, g)
+		if err != nil {
+			g.wg.Stop()
+			return err
+		}
+		g.input = input
+		s.groups[g.name] = g
+		loggo.Info("joinGroup new group %s %s %s", g.name, g.fromaddr, g.balance)
+	} else if g.fromaddr != f.LoginFrame.Fromaddr || g.proxyproto != f.LoginFrame.Proxyproto {
+		return errors.New("group " + g.name + " mismatch " + g.proxyproto.String() + " " + g.fromaddr)
+	}
+
+	g.add(clientConn)
+	clientConn.input = g.input
+	clientConn.group = g
+
+	loggo.Info("joinGroup %s %s %d", g.name, clientConn.conn.Info(), g.size())
+	return nil
+}
+
+// 主通道断了，成员退出，经过它的连接都关掉，最后一个成员退出时关掉监听
+func (s *Server) leaveGroup(clientConn *ClientConn) {
+	g := clientConn.group
+
+	s.groupLock.Lock()
+	defer s.groupLock.Unlock()
+
+	left := g.remove(clientConn)
+	g.input.closeFatherSonny(&clientConn.ProxyConn)
+
+	loggo.Info("leaveGroup %s %s %d", g.name, clientConn.conn.Info(), left)
+
+	if left <= 0 {
+		g.input.Close()
+		g.wg.Stop()
+		delete(s.groups, g.name)
+		loggo.Info("leaveGroup close group %s %s", g.name, g.fromaddr)
+	}
+}
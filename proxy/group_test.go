@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func Test0011ServiceGroup(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	g := &serviceGroup{balance: GROUP_BALANCE_LEAST_CONN}
+	a := &ClientConn{}
+	b := &ClientConn{}
+	g.add(a)
+	g.add(b)
+
+	m1 := g.pick()
+	m2 := g.pick()
+	if m1.clientconn == m2.clientconn {
+		t.Fatal("least conn should pick the idle member")
+	}
+	g.done(m1)
+	m3 := g.pick()
+	if m3.clientconn != m1.clientconn {
+		t.Fatal("least conn should pick the member just released")
+	}
+
+	if g.remove(a) != 1 || g.pick().clientconn != b {
+		t.Fatal("removed member should not be picked")
+	}
+	g.remove(b)
+	if g.pick() != nil {
+		t.Fatal("empty group should pick nothing")
+	}
+
+	for i := 0; i < 2; i++ {
+		l := startPortServer(t, 32810+i)
+		defer l.Close()
+	}
+
+	config := DefaultConfig()
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:32800"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cconfig := DefaultConfig()
+	cconfig.Group = "test_group"
+
+	// 两个成员用同样的名字
+	c1, err := NewClient(cconfig, "tcp", "127.0.0.1:32800", "test_group", "REVERSE_PROXY", []string{"tcp"}, []string{"127.0.0.1:32801"}, []string{"127.0.0.1:32810"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	c2, err := NewClient(cconfig, "tcp", "127.0.0.1:32800", "test_group", "REVERSE_PROXY", []string{"tcp"}, []string{"127.0.0.1:32801"}, []string{"127.0.0.1:32811"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	seen := make(map[int]bool)
+	begin := time.Now()
+	for time.Since(begin) < 10*time.Second && len(seen) < 2 {
+		port, err := readPortServer("127.0.0.1:32801")
+		if err == nil {
+			seen[port] = true
+			continue
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if len(seen) < 2 {
+		t.Fatal("round robin should reach both members", seen)
+	}
+
+	// 一个成员下线后，连接都去另一个成员
+	c1.Close()
+	begin = time.Now()
+	for time.Since(begin) < 10*time.Second {
+		ok := true
+		for i := 0; i < 4; i++ {
+			if port, err := readPortServer("127.0.0.1:32801"); err != nil || port != 32811 {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Fatal("all connections should go to the online member " + strconv.Itoa(32811))
+}
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/thread"
+)
+
+// 逐跳头部，不能转发给下一跳
+var httpHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func NewHttpProxyInputer(wg *thread.Group, proto string, addr string, clienttype CLIENT_TYPE, config *Config, father *ProxyConn) (*Inputer, error) {
+	// CONNECT之后要接着用bufio里剩下的数据，需要拿到原始的net.Conn
+	listenconn, err := listenNetConn(proto, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &Inputer{
+		clienttype: clienttype,
+		config:     config,
+		proto:      proto,
+		addr:       addr,
+		father:     father,
+		fwg:        wg,
+		listenconn: listenconn,
+	}
+
+	// 普通的http代理请求，每个目标host开一个sonny，用pipe接到transport上，由transport负责keep-alive
+	input.transport = &http.Transport{
+		Proxy:                 nil,
+		DialContext:           input.dialHttpProxy,
+		DisableCompression:    true,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       time.Duration(config.ConnTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(config.ConnTimeout) * time.Second,
+	}
+
+	wg.Go("Inputer listenHttpProxy"+" "+addr, func() error {
+		return input.listenHttpProxy()
+	})
+
+	loggo.Info("NewInputer ok %s", addr)
+
+	return input, nil
+}
+
+func (i *Inputer) listenHttpProxy() error {
+
+	loggo.Info("Inputer start listenHttpProxy %s", i.addr)
+
+	for !i.fwg.IsExit() && !i.isClosed() {
+		conn, err := i.listenconn.Accept()
+		if err != nil {
+			loggo.Info("Inputer listen Accept fail %s", err)
+			continue
+		}
+
+		size := i.sonnySize()
+		if size >= i.config.MaxSonny {
+			loggo.Info("Inputer listen max sonny %s %d", conn.Info(), size)
+			conn.Close()
+			continue
+		}
+
+		proxyconn := &ProxyConn{conn: conn}
+		i.fwg.Go("Inputer processHttpProxyConn"+" "+conn.Info(), func() error {
+			atomic.AddInt32(&gStateThreadNum.InputerSonnyThread, 1)
+			defer atomic.AddInt32(&gStateThreadNum.InputerSonnyThread, -1)
+			if !acceptProxyProtocol(conn, i.config) {
+				return nil
+			}
+			return i.processHttpProxyConn(proxyconn)
+		})
+	}
+	loggo.Info("Inputer end listenHttpProxy %s", i.addr)
+	return nil
+}
+
+func (i *Inputer) processHttpProxyConn(proxyConn *ProxyConn) error {
+
+	loggo.Info("processHttpProxyConn start %s", proxyConn.conn.Info())
+
+	wg := thread.NewGroup("Inputer processHttpProxyConn"+" "+proxyConn.conn.Info(), i.fwg, func() {
+		loggo.Info("group start exit %s", proxyConn.conn.Info())
+		proxyConn.conn.Close()
+		loggo.Info("group end exit %s", proxyConn.conn.Info())
+	})
+
+	targetAddr := ""
+	wg.Go("Inputer httpproxy"+" "+proxyConn.conn.Info(), func() error {
+		nc, ok := proxyConn.conn.(*netConn)
+		if !ok {
+			loggo.Error("processHttpProxyConn no tcp %s %s", proxyConn.conn.Info(), proxyConn.conn.Name())
+			return errors.New("http proxy not tcp")
+		}
+
+		reader := bufio.NewReader(nc.reader)
+		for !wg.IsExit() {
+			req, err := http.ReadRequest(reader)
+			if err != nil {
+				if err != io.EOF {
+					loggo.Error("processHttpProxyConn ReadRequest %s %s", proxyConn.conn.Info(), err)
+				}
+				return err
+			}
+
+			if i.needAuth() && !i.checkHttpProxyAuth(req) {
+				writeHttpProxyError(nc.conn, http.StatusProxyAuthRequired)
+				loggo.Error("processHttpProxyConn auth fail %s", proxyConn.conn.Info())
+				return errors.New("http proxy auth fail")
+			}
+
+			if req.Method == http.MethodConnect {
+				addr := req.Host
+				if _, _, err := net.SplitHostPort(addr); err != nil {
+					addr = net.JoinHostPort(addr, "443")
+				}
+				_, err = nc.conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				if err != nil {
+					loggo.Error("processHttpProxyConn Write %s %s", proxyConn.conn.Info(), err)
+					return err
+				}
+				// bufio里可能已经读了隧道里的数据
+				cc := newNetConn(nc.conn, reader)
+				cc.remote = nc.remote
+				proxyConn.conn = cc
+				targetAddr = addr
+				return nil
+			}
+
+			closed, err := i.roundTripHttpProxy(nc.conn, req)
+			if err != nil {
+				return err
+			}
+			if closed {
+				return errors.New("http proxy conn close")
+			}
+		}
+		return nil
+	})
+
+	err := wg.Wait()
+	if err != nil {
+		return nil
+	}
+
+	if len(targetAddr) <= 0 {
+		proxyConn.conn.Close()
+		return nil
+	}
+
+	loggo.Info("processHttpProxyConn connect ok %s %s", proxyConn.conn.Info(), targetAddr)
+
+	i.fwg.Go("Inputer processProxyConn"+" "+proxyConn.conn.Info(), func() error {
+		return i.processProxyConn(proxyConn, targetAddr)
+	})
+
+	return nil
+}
+
+// 转发一个absolute-URI的请求，返回客户端连接是否需要关闭
+func (i *Inputer) roundTripHttpProxy(conn net.Conn, req *http.Request) (bool, error) {
+	if !req.URL.IsAbs() || (req.URL.Scheme != "http" && req.URL.Scheme != "https") {
+		writeHttpProxyError(conn, http.StatusBadRequest)
+		loggo.Error("roundTripHttpProxy not absolute uri %s %s", conn.RemoteAddr(), req.RequestURI)
+		return true, errors.New("http proxy not absolute uri")
+	}
+
+	loggo.Info("roundTripHttpProxy %s %s %s", conn.RemoteAddr(), req.Method, req.URL.String())
+
+	closed := req.Close
+	req.Close = false
+	req.RequestURI = ""
+	removeHttpHopHeaders(req.Header)
+
+	// transport可能在返回响应后还在读请求body，等它读完才能读下一个请求
+	var body *httpProxyBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &httpProxyBody{ReadCloser: req.Body, done: make(chan struct{})}
+		req.Body = body
+	}
+
+	rsp, err := i.transport.RoundTrip(req)
+	if err != nil {
+		writeHttpProxyError(conn, http.StatusBadGateway)
+		loggo.Error("roundTripHttpProxy RoundTrip %s %s %s", conn.RemoteAddr(), req.URL.Host, err)
+		return true, err
+	}
+
+	removeHttpHopHeaders(rsp.Header)
+	rsp.Close = rsp.Close || closed
+	err = rsp.Write(conn)
+	rsp.Body.Close()
+	if err != nil {
+		loggo.Error("roundTripHttpProxy Write %s %s", conn.RemoteAddr(), err)
+		return true, err
+	}
+
+	if body != nil {
+		<-body.done
+	}
+
+	return rsp.Close, nil
+}
+
+// transport需要新连接时，开一个到目标的sonny，另一端交给transport
+func (i *Inputer) dialHttpProxy(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return i.dialPipe(addr)
+}
+
+func (i *Inputer) dialPipe(targetAddr string) (net.Conn, error) {
+	size := i.sonnySize()
+	if size >= i.config.MaxSonny {
+		loggo.Info("Inputer dialPipe max sonny %s %d", targetAddr, size)
+		return nil, errors.New("max sonny")
+	}
+
+	local, remote := net.Pipe()
+	proxyconn := &ProxyConn{conn: newNetConn(remote, nil)}
+	i.fwg.Go("Inputer processProxyConn"+" "+targetAddr, func() error {
+		atomic.AddInt32(&gStateThreadNum.InputerSonnyThread, 1)
+		defer atomic.AddInt32(&gStateThreadNum.InputerSonnyThread, -1)
+		return i.processProxyConn(proxyconn, targetAddr)
+	})
+	return local, nil
+}
+
+func (i *Inputer) checkHttpProxyAuth(req *http.Request) bool {
+	auth, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return false
+	}
+	return i.checkUser(user, password)
+}
+
+func removeHttpHopHeaders(header http.Header) {
+	for _, f := range header["Connection"] {
+		for _, h := range strings.Split(f, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				header.Del(h)
+			}
+		}
+	}
+	for _, h := range httpHopHeaders {
+		header.Del(h)
+	}
+}
+
+func writeHttpProxyError(w io.Writer, code int) error {
+	rsp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: 0,
+		Close:         true,
+	}
+	if code == http.StatusProxyAuthRequired {
+		rsp.Header.Set("Proxy-Authenticate", "Basic realm=\"spp\"")
+	}
+	return rsp.Write(w)
+}
+
+type httpProxyBody struct {
+	io.ReadCloser
+	done chan struct{}
+	once sync.Once
+}
+
+func (b *httpProxyBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		close(b.done)
+	})
+	return err
+}
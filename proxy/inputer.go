@@ -2,8 +2,13 @@ package proxy
 
 import (
 	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/loggo"
@@ -19,34 +24,58 @@ type Inputer struct {
 	father     *ProxyConn
 	fwg        *thread.Group
 
-	listenconn network.Conn
-	sonny      sync.Map
+	listenconn  network.Conn
+	listenconns []network.Conn // 端口范围时每个端口一个
+	sonny       sync.Map
+	transport   *http.Transport
+	group       *serviceGroup
+	counter     streamCounter
+	closed      int32 // 关掉监听以后Accept会一直失败，靠这个退出
 }
 
 func NewInputer(wg *thread.Group, proto string, addr string, clienttype CLIENT_TYPE, config *Config, father *ProxyConn, targetAddr string) (*Inputer, error) {
-	conn, err := network.NewConn(proto)
-	if conn == nil {
-		return nil, err
-	}
+	return newInputer(wg, proto, addr, clienttype, config, father, nil, targetAddr)
+}
 
-	listenconn, err := conn.Listen(addr)
+// 服务组的Inputer没有固定的主通道，每个连接从组里挑一个成员，目标地址用成员的toaddr
+func NewGroupInputer(wg *thread.Group, proto string, addr string, clienttype CLIENT_TYPE, config *Config, group *serviceGroup) (*Inputer, error) {
+	return newInputer(wg, proto, addr, clienttype, config, nil, group, "")
+}
+
+func newInputer(wg *thread.Group, proto string, addr string, clienttype CLIENT_TYPE, config *Config, father *ProxyConn, group *serviceGroup, targetAddr string) (*Inputer, error) {
+	addrs, targetAddrs, err := splitPortRange(addr, targetAddr)
 	if err != nil {
 		return nil, err
 	}
 
+	var listenconns []network.Conn
+	for _, a := range addrs {
+		listenconn, err := listenNetConn(proto, a)
+		if err != nil {
+			closeListenConns(listenconns)
+			return nil, err
+		}
+		listenconns = append(listenconns, listenconn)
+	}
+
 	input := &Inputer{
-		clienttype: clienttype,
-		config:     config,
-		proto:      proto,
-		addr:       addr,
-		father:     father,
-		fwg:        wg,
-		listenconn: listenconn,
+		clienttype:  clienttype,
+		config:      config,
+		proto:       proto,
+		addr:        addr,
+		father:      father,
+		fwg:         wg,
+		listenconns: listenconns,
+		group:       group,
 	}
 
-	wg.Go("Inputer listen"+" "+targetAddr, func() error {
-		return input.listen(targetAddr)
-	})
+	for index, _ := range listenconns {
+		listenconn := listenconns[index]
+		target := targetAddrs[index]
+		wg.Go("Inputer listen"+" "+target, func() error {
+			return input.listen(listenconn, target)
+		})
+	}
 
 	loggo.Info("NewInputer ok %s", addr)
 
@@ -54,12 +83,8 @@ func NewInputer(wg *thread.Group, proto string, addr string, clienttype CLIENT_T
 }
 
 func NewSocks5Inputer(wg *thread.Group, proto string, addr string, clienttype CLIENT_TYPE, config *Config, father *ProxyConn) (*Inputer, error) {
-	conn, err := network.NewConn(proto)
-	if conn == nil {
-		return nil, err
-	}
-
-	listenconn, err := conn.Listen(addr)
+	// socks5需要拿到tcp连接的本地地址来绑定udp中继
+	listenconn, err := listenNetConn(proto, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -83,8 +108,38 @@ func NewSocks5Inputer(wg *thread.Group, proto string, addr string, clienttype CL
 	return input, nil
 }
 
+// tcp时直接用标准库监听，accept出来的连接可以拿到原始的net.Conn
+func listenNetConn(proto string, addr string) (network.Conn, error) {
+	if strings.ToLower(proto) == "tcp" {
+		return listenTcp(addr)
+	}
+
+	conn, err := network.NewConn(proto)
+	if conn == nil {
+		return nil, err
+	}
+	return conn.Listen(addr)
+}
+
+func closeListenConns(listenconns []network.Conn) {
+	for _, conn := range listenconns {
+		conn.Close()
+	}
+}
+
 func (i *Inputer) Close() {
-	i.listenconn.Close()
+	atomic.StoreInt32(&i.closed, 1)
+	if i.listenconn != nil {
+		i.listenconn.Close()
+	}
+	closeListenConns(i.listenconns)
+	if i.transport != nil {
+		i.transport.CloseIdleConnections()
+	}
+}
+
+func (i *Inputer) isClosed() bool {
+	return atomic.LoadInt32(&i.closed) != 0
 }
 
 func (i *Inputer) processDataFrame(f *ProxyFrame) {
@@ -96,10 +151,12 @@ func (i *Inputer) processDataFrame(f *ProxyFrame) {
 	}
 	sonny := v.(*ProxyConn)
 	if !sonny.sendch.WriteTimeout(f, i.config.MainWriteChannelTimeoutMs) {
-		sonny.needclose = true
+		sonny.setCloseReason("send timeout")
+		sonny.needclose.Store(true)
 		loggo.Error("Inputer processDataFrame timeout sonnny %s %d", f.DataFrame.Id, len(f.DataFrame.Data))
 	}
 	sonny.actived++
+	i.counter.send(sonny, int64(len(f.DataFrame.Data)))
 	loggo.Debug("Inputer processDataFrame %s %d", f.DataFrame.Id, len(f.DataFrame.Data))
 }
 
@@ -123,21 +180,23 @@ func (i *Inputer) processOpenRspFrame(f *ProxyFrame) {
 		return
 	}
 	sonny := v.(*ProxyConn)
+	sonny.opentime = time.Since(sonny.begin)
 	if f.OpenRspFrame.Ret {
-		sonny.established = true
+		sonny.established.Store(true)
 		loggo.Info("Inputer processOpenRspFrame ok %s %s", id, sonny.conn.Info())
 	} else {
-		sonny.needclose = true
-		loggo.Info("Inputer processOpenRspFrame fail %s %s", id, sonny.conn.Info())
+		sonny.setCloseReason("open fail " + f.OpenRspFrame.Msg)
+		sonny.needclose.Store(true)
+		loggo.Info("Inputer processOpenRspFrame fail %s %s %s", id, sonny.conn.Info(), f.OpenRspFrame.Msg)
 	}
 }
 
-func (i *Inputer) listen(targetAddr string) error {
+func (i *Inputer) listen(listenconn network.Conn, targetAddr string) error {
 
-	loggo.Info("Inputer start listen %s %s", i.addr, targetAddr)
+	loggo.Info("Inputer start listen %s %s", listenconn.Info(), targetAddr)
 
-	for !i.fwg.IsExit() {
-		conn, err := i.listenconn.Accept()
+	for !i.fwg.IsExit() && !i.isClosed() {
+		conn, err := listenconn.Accept()
 		if err != nil {
 			loggo.Info("Inputer listen Accept fail %s", err)
 			continue
@@ -154,10 +213,13 @@ func (i *Inputer) listen(targetAddr string) error {
 		i.fwg.Go("Inputer processProxyConn"+" "+targetAddr, func() error {
 			atomic.AddInt32(&gStateThreadNum.InputerSonnyThread, 1)
 			defer atomic.AddInt32(&gStateThreadNum.InputerSonnyThread, -1)
+			if !acceptProxyProtocol(conn, i.config) {
+				return nil
+			}
 			return i.processProxyConn(proxyconn, targetAddr)
 		})
 	}
-	loggo.Info("Inputer end listen %s", i.addr)
+	loggo.Info("Inputer end listen %s", listenconn.Info())
 	return nil
 }
 
@@ -165,7 +227,7 @@ func (i *Inputer) listenSocks5() error {
 
 	loggo.Info("Inputer start listenSocks5 %s", i.addr)
 
-	for !i.fwg.IsExit() {
+	for !i.fwg.IsExit() && !i.isClosed() {
 		conn, err := i.listenconn.Accept()
 		if err != nil {
 			loggo.Info("Inputer listen Accept fail %s", err)
@@ -183,6 +245,9 @@ func (i *Inputer) listenSocks5() error {
 		i.fwg.Go("Inputer processSocks5Conn"+" "+conn.Info(), func() error {
 			atomic.AddInt32(&gStateThreadNum.InputerSonnyThread, 1)
 			defer atomic.AddInt32(&gStateThreadNum.InputerSonnyThread, -1)
+			if !acceptProxyProtocol(conn, i.config) {
+				return nil
+			}
 			return i.processSocks5Conn(proxyconn)
 		})
 	}
@@ -201,31 +266,80 @@ func (i *Inputer) processSocks5Conn(proxyConn *ProxyConn) error {
 	})
 
 	targetAddr := ""
+	user := ""
+	var udpconn *net.UDPConn
 	wg.Go("Inputer socks5"+" "+proxyConn.conn.Info(), func() error {
 		if proxyConn.conn.Name() != "tcp" {
 			loggo.Error("processSocks5Conn no tcp %s %s", proxyConn.conn.Info(), proxyConn.conn.Name())
 			return errors.New("socks5 not tcp")
 		}
 
-		var err error = nil
-		if err = network.Sock5HandshakeBy(proxyConn.conn, i.config.Username, i.config.Password); err != nil {
-			loggo.Error("processSocks5Conn Sock5HandshakeBy %s %s", proxyConn.conn.Info(), err)
+		ver := make([]byte, 1)
+		if _, err := io.ReadFull(proxyConn.conn, ver); err != nil {
+			loggo.Error("processSocks5Conn read version %s %s", proxyConn.conn.Info(), err)
 			return err
 		}
-		_, addr, err := network.Sock5GetRequest(proxyConn.conn)
+
+		if ver[0] == SOCKS4_VERSION {
+			addr, userid, err := i.processSocks4Request(proxyConn)
+			if err != nil {
+				return err
+			}
+			targetAddr = addr
+			user = userid
+			return nil
+		}
+
+		if ver[0] != SOCKS5_VERSION {
+			loggo.Error("processSocks5Conn version error %s %d", proxyConn.conn.Info(), ver[0])
+			return errors.New("socks version error")
+		}
+
+		username, err := socks5ServerHandshake(proxyConn.conn, i.checkUser, i.needAuth())
 		if err != nil {
-			loggo.Error("processSocks5Conn Sock5GetRequest %s %s", proxyConn.conn.Info(), err)
+			loggo.Error("processSocks5Conn socks5ServerHandshake %s %s", proxyConn.conn.Info(), err)
 			return err
 		}
-		// Sending connection established message immediately to client.
-		// This some round trip time for creating socks connection with the client.
-		// But if connection failed, the client will get connection reset error.
-		_, err = proxyConn.conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
+		if len(username) > 0 {
+			loggo.Info("processSocks5Conn auth ok %s %s", proxyConn.conn.Info(), username)
+		}
+		user = username
+
+		cmd, addr, err := socks5ReadRequest(proxyConn.conn)
 		if err != nil {
-			loggo.Error("processSocks5Conn Write %s %s", proxyConn.conn.Info(), err)
+			loggo.Error("processSocks5Conn socks5ReadRequest %s %s", proxyConn.conn.Info(), err)
 			return err
 		}
 
+		switch cmd {
+		case SOCKS5_CMD_CONNECT:
+			// Sending connection established message immediately to client.
+			// This some round trip time for creating socks connection with the client.
+			// But if connection failed, the client will get connection reset error.
+			_, err = proxyConn.conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
+			if err != nil {
+				loggo.Error("processSocks5Conn Write %s %s", proxyConn.conn.Info(), err)
+				return err
+			}
+		case SOCKS5_CMD_UDP_ASSOCIATE:
+			udpconn, err = i.listenUdpRelay(proxyConn)
+			if err != nil {
+				socks5WriteReply(proxyConn.conn, SOCKS5_REP_FAIL, "")
+				loggo.Error("processSocks5Conn listenUdpRelay %s %s", proxyConn.conn.Info(), err)
+				return err
+			}
+			err = socks5WriteReply(proxyConn.conn, SOCKS5_REP_SUCCESS, udpconn.LocalAddr().String())
+			if err != nil {
+				udpconn.Close()
+				loggo.Error("processSocks5Conn Write %s %s", proxyConn.conn.Info(), err)
+				return err
+			}
+		default:
+			socks5WriteReply(proxyConn.conn, SOCKS5_REP_CMD_NOT_SUPPORTED, "")
+			loggo.Error("processSocks5Conn cmd not supported %s %d", proxyConn.conn.Info(), cmd)
+			return errors.New("socks5 cmd not supported")
+		}
+
 		targetAddr = addr
 		return nil
 	})
@@ -235,6 +349,18 @@ func (i *Inputer) processSocks5Conn(proxyConn *ProxyConn) error {
 		return nil
 	}
 
+	proxyConn.user = user
+
+	if udpconn != nil {
+		loggo.Info("processSocks5Conn udp associate ok %s %s %s", proxyConn.conn.Info(), udpconn.LocalAddr(), targetAddr)
+
+		i.fwg.Go("Inputer processUdpAssociate"+" "+proxyConn.conn.Info(), func() error {
+			return i.processUdpAssociate(proxyConn, udpconn)
+		})
+
+		return nil
+	}
+
 	loggo.Info("processSocks5Conn ok %s %s", proxyConn.conn.Info(), targetAddr)
 
 	i.fwg.Go("Inputer processProxyConn"+" "+proxyConn.conn.Info(), func() error {
@@ -247,6 +373,19 @@ func (i *Inputer) processSocks5Conn(proxyConn *ProxyConn) error {
 func (i *Inputer) processProxyConn(proxyConn *ProxyConn, targetAddr string) error {
 
 	proxyConn.id = common.UniqueId()
+	proxyConn.father = i.father
+
+	if i.group != nil {
+		member := i.group.pick()
+		if member == nil {
+			loggo.Info("Inputer processProxyConn no group member %s %s", i.group.name, proxyConn.conn.Info())
+			proxyConn.conn.Close()
+			return nil
+		}
+		defer i.group.done(member)
+		proxyConn.father = &member.clientconn.ProxyConn
+		targetAddr = member.clientconn.toaddr
+	}
 
 	loggo.Info("Inputer processProxyConn start %s %s %s", proxyConn.id, proxyConn.conn.Info(), targetAddr)
 
@@ -257,7 +396,7 @@ func (i *Inputer) processProxyConn(proxyConn *ProxyConn, targetAddr string) erro
 		return nil
 	}
 
-	sendch := common.NewChannel(i.config.ConnBuffer)
+	sendch := common.NewChannel(sonnyConnBuffer(i.config, proxyConn.father))
 	recvch := common.NewChannel(i.config.ConnBuffer)
 
 	proxyConn.sendch = sendch
@@ -273,12 +412,19 @@ func (i *Inputer) processProxyConn(proxyConn *ProxyConn, targetAddr string) erro
 
 	i.openConn(proxyConn, targetAddr)
 
+	i.counter.open(proxyConn.father)
+	defer i.counter.close(proxyConn.father)
+
 	wg.Go("Inputer recvFromSonny"+" "+proxyConn.conn.Info(), func() error {
-		return recvFromSonny(wg, recvch, proxyConn.conn, i.config.MaxMsgSize)
+		err := recvFromSonny(wg, recvch, proxyConn.conn, i.config.MaxMsgSize)
+		if err == nil && !wg.IsExit() {
+			proxyConn.setCloseReason("local eof")
+		}
+		return err
 	})
 
 	wg.Go("Inputer sendToSonny"+" "+proxyConn.conn.Info(), func() error {
-		return sendToSonny(wg, sendch, proxyConn.conn, i.config.MaxMsgSize)
+		return sendToSonny(wg, sendch, proxyConn, i.config.MaxMsgSize)
 	})
 
 	wg.Go("Inputer checkSonnyActive"+" "+proxyConn.conn.Info(), func() error {
@@ -290,30 +436,193 @@ func (i *Inputer) processProxyConn(proxyConn *ProxyConn, targetAddr string) erro
 	})
 
 	wg.Go("Inputer copySonnyRecv"+" "+proxyConn.conn.Info(), func() error {
-		return copySonnyRecv(wg, recvch, proxyConn, i.father)
+		return copySonnyRecv(wg, recvch, proxyConn, proxyConn.father, &i.counter)
 	})
 
-	wg.Wait()
+	err := wg.Wait()
 	i.sonny.Delete(proxyConn.id)
 
-	closeRemoteConn(proxyConn, i.father)
+	closeRemoteConn(proxyConn, proxyConn.father)
+	writeAccessLog(i.config, "inputer", proxyConn, err)
 
 	loggo.Info("Inputer processProxyConn end %s %s %s", proxyConn.id, proxyConn.conn.Info(), targetAddr)
 
 	return nil
 }
 
+// 返回目标地址和认证过的用户名
+func (i *Inputer) processSocks4Request(proxyConn *ProxyConn) (string, string, error) {
+	cmd, userid, addr, err := socks4ReadRequest(proxyConn.conn)
+	if err != nil {
+		loggo.Error("processSocks5Conn socks4ReadRequest %s %s", proxyConn.conn.Info(), err)
+		return "", "", err
+	}
+
+	user := ""
+	if i.needAuth() {
+		u, ok := socks4CheckUserid(userid, i.checkUser)
+		if !ok {
+			socks4WriteReply(proxyConn.conn, SOCKS4_REP_USERID_FAILED)
+			loggo.Error("processSocks5Conn socks4 auth fail %s %s", proxyConn.conn.Info(), u)
+			return "", "", errors.New("socks4 auth fail")
+		}
+		loggo.Info("processSocks5Conn socks4 auth ok %s %s", proxyConn.conn.Info(), u)
+		user = u
+	}
+
+	if cmd != SOCKS4_CMD_CONNECT {
+		socks4WriteReply(proxyConn.conn, SOCKS4_REP_REJECTED)
+		loggo.Error("processSocks5Conn socks4 cmd not supported %s %d", proxyConn.conn.Info(), cmd)
+		return "", "", errors.New("socks4 cmd not supported")
+	}
+
+	err = socks4WriteReply(proxyConn.conn, SOCKS4_REP_GRANTED)
+	if err != nil {
+		loggo.Error("processSocks5Conn Write %s %s", proxyConn.conn.Info(), err)
+		return "", "", err
+	}
+
+	return addr, user, nil
+}
+
+func (i *Inputer) needAuth() bool {
+	return len(i.config.Username) > 0 || len(i.config.Password) > 0
+}
+
+func (i *Inputer) checkUser(user string, password string) bool {
+	return user == i.config.Username && password == i.config.Password
+}
+
+func (i *Inputer) listenUdpRelay(proxyConn *ProxyConn) (*net.UDPConn, error) {
+	nc, ok := proxyConn.conn.(*netConn)
+	if !ok {
+		return nil, errors.New("udp associate need tcp conn")
+	}
+	laddr := &net.UDPAddr{IP: nc.LocalAddr().(*net.TCPAddr).IP}
+	return net.ListenUDP("udp", laddr)
+}
+
+func (i *Inputer) processUdpAssociate(proxyConn *ProxyConn, udpconn *net.UDPConn) error {
+
+	proxyConn.id = common.UniqueId()
+	proxyConn.father = i.father
+
+	loggo.Info("Inputer processUdpAssociate start %s %s %s", proxyConn.id, proxyConn.conn.Info(), udpconn.LocalAddr())
+
+	_, loaded := i.sonny.LoadOrStore(proxyConn.id, proxyConn)
+	if loaded {
+		loggo.Error("Inputer processUdpAssociate LoadOrStore fail %s", proxyConn.id)
+		proxyConn.conn.Close()
+		udpconn.Close()
+		return nil
+	}
+
+	sendch := common.NewChannel(sonnyConnBuffer(i.config, proxyConn.father))
+	recvch := common.NewChannel(i.config.ConnBuffer)
+
+	proxyConn.sendch = sendch
+	proxyConn.recvch = recvch
+
+	wg := thread.NewGroup("Inputer processUdpAssociate"+" "+proxyConn.conn.Info(), i.fwg, func() {
+		loggo.Info("group start exit %s", proxyConn.conn.Info())
+		proxyConn.conn.Close()
+		udpconn.Close()
+		sendch.Close()
+		recvch.Close()
+		loggo.Info("group end exit %s", proxyConn.conn.Info())
+	})
+
+	i.openUdp(proxyConn)
+
+	i.counter.open(i.father)
+	defer i.counter.close(i.father)
+
+	// 只接受来自tcp控制连接同一ip的udp包，第一个包的来源地址作为回包地址
+	clientip := proxyConn.conn.(*netConn).RemoteAddr().(*net.TCPAddr).IP
+	var clientaddr atomic.Value
+
+	wg.Go("Inputer checkUdpControl"+" "+proxyConn.conn.Info(), func() error {
+		return checkUdpControl(wg, proxyConn.conn)
+	})
+
+	wg.Go("Inputer recvFromUdpClient"+" "+proxyConn.conn.Info(), func() error {
+		return recvFromUdpClient(wg, recvch, udpconn, clientip, &clientaddr, i.config.MaxMsgSize)
+	})
+
+	wg.Go("Inputer sendToUdpClient"+" "+proxyConn.conn.Info(), func() error {
+		return sendToUdpClient(wg, sendch, udpconn, &clientaddr)
+	})
+
+	wg.Go("Inputer checkSonnyActive"+" "+proxyConn.conn.Info(), func() error {
+		return checkSonnyActive(wg, proxyConn, i.config.EstablishedTimeout, i.config.ConnTimeout)
+	})
+
+	wg.Go("Inputer checkNeedClose"+" "+proxyConn.conn.Info(), func() error {
+		return checkNeedClose(wg, proxyConn)
+	})
+
+	wg.Go("Inputer copySonnyRecv"+" "+proxyConn.conn.Info(), func() error {
+		return copySonnyRecv(wg, recvch, proxyConn, i.father, &i.counter)
+	})
+
+	err := wg.Wait()
+	i.sonny.Delete(proxyConn.id)
+
+	closeRemoteConn(proxyConn, i.father)
+	writeAccessLog(i.config, "inputer", proxyConn, err)
+
+	loggo.Info("Inputer processUdpAssociate end %s %s", proxyConn.id, proxyConn.conn.Info())
+
+	return nil
+}
+
+func (i *Inputer) openUdp(proxyConn *ProxyConn) {
+	f := &ProxyFrame{}
+	f.Type = FRAME_TYPE_OPEN
+	f.OpenFrame = &OpenConnFrame{}
+	f.OpenFrame.Id = proxyConn.id
+	f.OpenFrame.Udp = true
+	f.OpenFrame.User = proxyConn.user
+
+	proxyConn.target = "udp"
+	proxyConn.source, _ = connAddrs(proxyConn.conn)
+	proxyConn.begin = time.Now()
+
+	i.father.sendch.Write(f)
+	loggo.Info("Inputer openUdp %s", proxyConn.id)
+}
+
 func (i *Inputer) openConn(proxyConn *ProxyConn, targetAddr string) {
 	f := &ProxyFrame{}
 	f.Type = FRAME_TYPE_OPEN
 	f.OpenFrame = &OpenConnFrame{}
 	f.OpenFrame.Id = proxyConn.id
 	f.OpenFrame.Toaddr = targetAddr
+	f.OpenFrame.Srcaddr, f.OpenFrame.Dstaddr = connAddrs(proxyConn.conn)
+	f.OpenFrame.User = proxyConn.user
 
-	i.father.sendch.Write(f)
+	proxyConn.target = targetAddr
+	proxyConn.source = f.OpenFrame.Srcaddr
+	if len(proxyConn.source) <= 0 {
+		proxyConn.source = proxyConn.conn.Info()
+	}
+	proxyConn.begin = time.Now()
+
+	proxyConn.father.sendch.Write(f)
 	loggo.Info("Inputer openConn %s %s", proxyConn.id, targetAddr)
 }
 
+func (i *Inputer) closeFatherSonny(father *ProxyConn) {
+	i.sonny.Range(func(key, value interface{}) bool {
+		sonny := value.(*ProxyConn)
+		if sonny.father == father {
+			sonny.setCloseReason("father close")
+			sonny.needclose.Store(true)
+		}
+		return true
+	})
+}
+
 func (i *Inputer) sonnySize() int {
 	size := 0
 	i.sonny.Range(func(key, value interface{}) bool {
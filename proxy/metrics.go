@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 和State不一样，这里的计数只增不清零，按主通道区分，给/metrics用
+type metricsLabels struct {
+	role   string // server client
+	client string
+	tunnel string
+	proto  string
+}
+
+// ping的rtt分桶，单位秒
+var metricsRttBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type tunnelMetrics struct {
+	labels metricsLabels
+	refs   int // 用这组label的主通道数，gMetrics.lock保护，减到0删掉
+
+	recvBytes        int64
+	sendBytes        int64
+	recvFrames       int64
+	sendFrames       int64
+	recvCompSaveSize int64
+	sendCompSaveSize int64
+	streams          int64
+	dialFail         int64
+	throttles        int64
+	throttledNs      int64
+	openRejects      int64
+
+	rttLock    sync.Mutex
+	rttBuckets []int64
+	rttSum     float64
+	rttCount   int64
+}
+
+type metricsRegistry struct {
+	lock    sync.Mutex
+	metrics map[metricsLabels]*tunnelMetrics
+}
+
+var gMetrics = &metricsRegistry{metrics: make(map[metricsLabels]*tunnelMetrics)}
+
+// 登录失败时名字等都是对方随便发的，不能当label，只记一个总数
+var gLoginFailures int64
+
+func metricsTunnel(fromaddr string, toaddr string) string {
+	if len(toaddr) <= 0 {
+		return fromaddr
+	}
+	return fromaddr + "->" + toaddr
+}
+
+func getMetrics(role string, client string, fromaddr string, toaddr string, proto PROXY_PROTO) *tunnelMetrics {
+	labels := metricsLabels{
+		role:   role,
+		client: client,
+		tunnel: metricsTunnel(fromaddr, toaddr),
+		proto:  strings.ToLower(proto.String()),
+	}
+
+	gMetrics.lock.Lock()
+	defer gMetrics.lock.Unlock()
+
+	m, ok := gMetrics.metrics[labels]
+	if !ok {
+		m = &tunnelMetrics{labels: labels, rttBuckets: make([]int64, len(metricsRttBuckets))}
+		gMetrics.metrics[labels] = m
+	}
+	m.refs++
+	return m
+}
+
+// 主通道关闭时调用，没有主通道用的label不再输出
+func releaseMetrics(m *tunnelMetrics) {
+	if m == nil {
+		return
+	}
+
+	gMetrics.lock.Lock()
+	defer gMetrics.lock.Unlock()
+
+	m.refs--
+	if m.refs <= 0 && gMetrics.metrics[m.labels] == m {
+		delete(gMetrics.metrics, m.labels)
+	}
+}
+
+// 下面的方法都允许m是nil，没登录的主通道不统计
+func (m *tunnelMetrics) recv(size int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.recvFrames, 1)
+	atomic.AddInt64(&m.recvBytes, size)
+}
+
+func (m *tunnelMetrics) send(size int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.sendFrames, 1)
+	atomic.AddInt64(&m.sendBytes, size)
+}
+
+func (m *tunnelMetrics) recvCompSave(size int64) {
+	if m == nil || size <= 0 {
+		return
+	}
+	atomic.AddInt64(&m.recvCompSaveSize, size)
+}
+
+func (m *tunnelMetrics) sendCompSave(size int64) {
+	if m == nil || size <= 0 {
+		return
+	}
+	atomic.AddInt64(&m.sendCompSaveSize, size)
+}
+
+func (m *tunnelMetrics) streamOpen() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.streams, 1)
+}
+
+func (m *tunnelMetrics) streamClose() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.streams, -1)
+}
+
+func (m *tunnelMetrics) dialFailed() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.dialFail, 1)
+}
+
+func metricsLoginFailed() {
+	atomic.AddInt64(&gLoginFailures, 1)
+}
+
+func (m *tunnelMetrics) throttle(wait time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.throttles, 1)
+	atomic.AddInt64(&m.throttledNs, int64(wait))
+}
+
+func (m *tunnelMetrics) openRejected() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.openRejects, 1)
+}
+
+func (m *tunnelMetrics) observeRtt(rtt time.Duration) {
+	if m == nil {
+		return
+	}
+	sec := rtt.Seconds()
+
+	m.rttLock.Lock()
+	defer m.rttLock.Unlock()
+
+	for i, b := range metricsRttBuckets {
+		if sec <= b {
+			m.rttBuckets[i]++
+		}
+	}
+	m.rttSum += sec
+	m.rttCount++
+}
+
+// 主通道的统计，sonny用father的
+func (p *ProxyConn) getMetrics() *tunnelMetrics {
+	if p == nil {
+		return nil
+	}
+	return p.metrics.Load()
+}
+
+func metricsLabelString(labels metricsLabels, extra string) string {
+	s := fmt.Sprintf(`role="%s",client="%s",tunnel="%s",proto="%s"`,
+		metricsEscape(labels.role), metricsEscape(labels.client), metricsEscape(labels.tunnel), metricsEscape(labels.proto))
+	if len(extra) > 0 {
+		s += "," + extra
+	}
+	return "{" + s + "}"
+}
+
+func metricsEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+// 按Prometheus的text格式输出
+func WriteMetrics(w io.Writer) {
+	gMetrics.lock.Lock()
+	var all []*tunnelMetrics
+	for _, m := range gMetrics.metrics {
+		all = append(all, m)
+	}
+	gMetrics.lock.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return metricsLabelString(all[i].labels, "") < metricsLabelString(all[j].labels, "")
+	})
+
+	counters := []struct {
+		name  string
+		typ   string
+		help  string
+		value func(m *tunnelMetrics) int64
+	}{
+		{"spp_recv_bytes_total", "counter", "Bytes received on the main connection.", func(m *tunnelMetrics) int64 { return atomic.LoadInt64(&m.recvBytes) }},
+		{"spp_send_bytes_total", "counter", "Bytes sent on the main connection.", func(m *tunnelMetrics) int64 { return atomic.LoadInt64(&m.sendBytes) }},
+		{"spp_recv_frames_total", "counter", "Frames received on the main connection.", func(m *tunnelMetrics) int64 { return atomic.LoadInt64(&m.recvFrames) }},
+		{"spp_send_frames_total", "counter", "Frames sent on the main connection.", func(m *tunnelMetrics) int64 { return atomic.LoadInt64(&m.sendFrames) }},
+		{"spp_recv_compress_saved_bytes_total", "counter", "Bytes saved by compression on received frames.", func(m *tunnelMetrics) int64 { return atomic.LoadInt64(&m.recvCompSaveSize) }},
+		{"spp_send_compress_saved_bytes_total", "counter", "Bytes saved by compression on sent frames.", func(m *tunnelMetrics) int64 { return atomic.LoadInt64(&m.sendCompSaveSize) }},
+		{"spp_active_streams", "gauge", "Streams currently open.", func(m *tunnelMetrics) int64 { return atomic.LoadInt64(&m.streams) }},
+		{"spp_dial_failures_total", "counter", "Failed dials to targets.", func(m *tunnelMetrics) int64 { return atomic.LoadInt64(&m.dialFail) }},
+		{"spp_throttled_total", "counter", "Times a stream waited for the rate limit.", func(m *tunnelMetrics) int64 { return atomic.LoadInt64(&m.throttles) }},
+		{"spp_open_rejected_total", "counter", "Streams refused by the per client quota.", func(m *tunnelMetrics) int64 { return atomic.LoadInt64(&m.openRejects) }},
+	}
+
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, c.typ)
+		for _, m := range all {
+			fmt.Fprintf(w, "%s%s %d\n", c.name, metricsLabelString(m.labels, ""), c.value(m))
+		}
+	}
+
+	name := "spp_login_failures_total"
+	fmt.Fprintf(w, "# HELP %s Failed logins.\n# TYPE %s counter\n", name, name)
+	fmt.Fprintf(w, "%s %d\n", name, atomic.LoadInt64(&gLoginFailures))
+
+	name = "spp_throttled_seconds_total"
+	fmt.Fprintf(w, "# HELP %s Time streams waited for the rate limit.\n# TYPE %s counter\n", name, name)
+	for _, m := range all {
+		sec := time.Duration(atomic.LoadInt64(&m.throttledNs)).Seconds()
+		fmt.Fprintf(w, "%s%s %s\n", name, metricsLabelString(m.labels, ""), strconv.FormatFloat(sec, 'g', -1, 64))
+	}
+
+	name = "spp_ping_rtt_seconds"
+	fmt.Fprintf(w, "# HELP %s Ping round trip time of the main connection.\n# TYPE %s histogram\n", name, name)
+	for _, m := range all {
+		m.rttLock.Lock()
+		for i, b := range metricsRttBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, metricsLabelString(m.labels, `le="`+strconv.FormatFloat(b, 'g', -1, 64)+`"`), m.rttBuckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, metricsLabelString(m.labels, `le="+Inf"`), m.rttCount)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, metricsLabelString(m.labels, ""), strconv.FormatFloat(m.rttSum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, metricsLabelString(m.labels, ""), m.rttCount)
+		m.rttLock.Unlock()
+	}
+}
+
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w)
+	})
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// 找带这些label的一行，返回值
+func metricsValue(text string, name string, labels ...string) (float64, bool) {
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(line, name+"{") && !strings.HasPrefix(line, name+" ") {
+			continue
+		}
+		match := true
+		for _, l := range labels {
+			if !strings.Contains(line, l) {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[strings.LastIndex(line, " ")+1:], 64)
+		return v, err == nil
+	}
+	return 0, false
+}
+
+func checkMetrics(timeout time.Duration, f func(text string) error) error {
+	var err error
+	begin := time.Now()
+	for time.Since(begin) < timeout {
+		var b bytes.Buffer
+		WriteMetrics(&b)
+		err = f(b.String())
+		if err == nil {
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return err
+}
+
+func Test0019Metrics(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	echo := startEcho(t, "tcp", "127.0.0.1:33502")
+	defer echo.Close()
+
+	// checkPingActive等EstablishedTimeout之后才开始ping
+	config := DefaultConfig()
+	config.EstablishedTimeout = 2
+
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:33500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := NewClient(config, "tcp", "127.0.0.1:33500", "test_metrics", "PROXY", []string{"tcp", "tcp"},
+		[]string{"127.0.0.1:33503", "127.0.0.1:33504"}, []string{"127.0.0.1:33502", "127.0.0.1:33505"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	wrong := DefaultConfig()
+	wrong.Key = "wrong"
+	wc, err := NewClient(wrong, "tcp", "127.0.0.1:33500", "test_metrics_wrong", "PROXY", []string{"tcp"}, []string{"127.0.0.1:33506"}, []string{"127.0.0.1:33502"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wc.Close()
+
+	if err := checkEcho("tcp", "127.0.0.1:33503", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:33503")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := echoOnce(conn, []byte("hello spp metrics")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没人监听的目标，server上Outputer拨号失败
+	if err := tryEcho("tcp", "127.0.0.1:33504"); err == nil {
+		t.Fatal("no target should fail")
+	}
+
+	server := []string{`role="server"`, `client="test_metrics_0"`, `tunnel="127.0.0.1:33503->127.0.0.1:33502"`, `proto="tcp"`}
+	client := []string{`role="client"`, `client="test_metrics_0"`, `tunnel="127.0.0.1:33503->127.0.0.1:33502"`, `proto="tcp"`}
+	err = checkMetrics(10*time.Second, func(text string) error {
+		for _, name := range []string{"spp_recv_bytes_total", "spp_send_bytes_total", "spp_recv_frames_total", "spp_send_frames_total", "spp_ping_rtt_seconds_count"} {
+			for _, labels := range [][]string{server, client} {
+				if v, ok := metricsValue(text, name, labels...); !ok || v <= 0 {
+					return echoError(name + " " + strings.Join(labels, ","))
+				}
+			}
+		}
+		// checkEcho的连接等不活跃超时才关，可能还在
+		if v, ok := metricsValue(text, "spp_active_streams", server...); !ok || v < 1 {
+			return echoError("server active streams")
+		}
+		if v, ok := metricsValue(text, "spp_active_streams", client...); !ok || v < 1 {
+			return echoError("client active streams")
+		}
+		if v, ok := metricsValue(text, "spp_dial_failures_total", `role="server"`, `tunnel="127.0.0.1:33504->127.0.0.1:33505"`); !ok || v <= 0 {
+			return echoError("dial failures")
+		}
+		// client和server上的失败都记在同一个没有label的计数里
+		if v, ok := metricsValue(text, "spp_login_failures_total"); !ok || v < 2 {
+			return echoError("login failures")
+		}
+		if strings.Contains(text, `client="test_metrics_wrong_0"`) {
+			return echoError("failed login should not have labels")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range s.Clients() {
+		for _, stream := range client.Streams {
+			s.CloseStream(stream.Id)
+		}
+	}
+	err = checkMetrics(10*time.Second, func(text string) error {
+		if v, ok := metricsValue(text, "spp_active_streams", server...); !ok || v != 0 {
+			return echoError("server active streams not closed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "# TYPE spp_ping_rtt_seconds histogram") ||
+		!strings.Contains(rec.Body.String(), `spp_ping_rtt_seconds_bucket{role="server",client="test_metrics_0",tunnel="127.0.0.1:33503->127.0.0.1:33502",proto="tcp",le="+Inf"}`) {
+		t.Fatal("metrics handler", rec.Body.String())
+	}
+
+	// 主通道关了，对应的label不再输出
+	c.Close()
+	err = checkMetrics(10*time.Second, func(text string) error {
+		if strings.Contains(text, `client="test_metrics_0"`) {
+			return echoError("closed tunnel metrics not removed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
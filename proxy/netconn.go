@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/esrrhs/gohome/network"
+)
+
+// netConn 把标准库的net.Conn或net.Listener包装成network.Conn，用于需要拿到原始连接的地方
+type netConn struct {
+	conn     net.Conn
+	reader   io.Reader
+	listener net.Listener
+	info     string
+	remote   net.Addr // PROXY protocol里的真实来源地址
+}
+
+func newNetConn(conn net.Conn, reader io.Reader) *netConn {
+	if reader == nil {
+		reader = conn
+	}
+	return &netConn{conn: conn, reader: reader}
+}
+
+func listenTcp(addr string) (network.Conn, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &netConn{listener: listener}, nil
+}
+
+func (c *netConn) Name() string {
+	if c.conn != nil {
+		return c.conn.LocalAddr().Network()
+	}
+	return "tcp"
+}
+
+func (c *netConn) Read(p []byte) (n int, err error) {
+	if c.reader != nil {
+		return c.reader.Read(p)
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *netConn) Write(p []byte) (n int, err error) {
+	if c.conn != nil {
+		return c.conn.Write(p)
+	}
+	return 0, errors.New("empty conn")
+}
+
+func (c *netConn) Close() error {
+	if c.conn != nil {
+		return c.conn.Close()
+	} else if c.listener != nil {
+		return c.listener.Close()
+	}
+	return nil
+}
+
+func (c *netConn) Info() string {
+	if c.info != "" {
+		return c.info
+	}
+	if c.conn != nil {
+		remote := ""
+		if c.RemoteAddr() != nil {
+			remote = c.RemoteAddr().String()
+		}
+		c.info = c.conn.LocalAddr().String() + "<--" + c.Name() + "-->" + remote
+	} else if c.listener != nil {
+		c.info = "tcp--" + c.listener.Addr().String()
+	} else {
+		c.info = "empty net conn"
+	}
+	return c.info
+}
+
+func (c *netConn) Dial(dst string) (network.Conn, error) {
+	return nil, errors.New("netConn can not dial")
+}
+
+func (c *netConn) Listen(dst string) (network.Conn, error) {
+	return nil, errors.New("netConn can not listen")
+}
+
+func (c *netConn) Accept() (network.Conn, error) {
+	if c.listener == nil {
+		return nil, errors.New("not listen")
+	}
+	conn, err := c.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newNetConn(conn, nil), nil
+}
+
+func (c *netConn) LocalAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	} else if c.listener != nil {
+		return c.listener.Addr()
+	}
+	return nil
+}
+
+func (c *netConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return nil
+}
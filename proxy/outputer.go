@@ -1,9 +1,12 @@
 package proxy
 
 import (
+	"net"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/loggo"
@@ -21,7 +24,9 @@ type Outputer struct {
 	conn  network.Conn
 	sonny sync.Map
 
-	ss bool
+	ss            bool
+	proxyprotocol string
+	counter       streamCounter
 }
 
 func NewOutputer(wg *thread.Group, proto string, clienttype CLIENT_TYPE, config *Config, father *ProxyConn) (*Outputer, error) {
@@ -31,12 +36,13 @@ func NewOutputer(wg *thread.Group, proto string, clienttype CLIENT_TYPE, config
 	}
 
 	output := &Outputer{
-		clienttype: clienttype,
-		config:     config,
-		conn:       conn,
-		proto:      proto,
-		father:     father,
-		fwg:        wg,
+		clienttype:    clienttype,
+		config:        config,
+		conn:          conn,
+		proto:         proto,
+		father:        father,
+		fwg:           wg,
+		proxyprotocol: config.ProxyProtocol,
 	}
 
 	loggo.Info("NewOutputer ok %s", proto)
@@ -78,10 +84,12 @@ func (o *Outputer) processDataFrame(f *ProxyFrame) {
 	}
 	sonny := v.(*ProxyConn)
 	if !sonny.sendch.WriteTimeout(f, o.config.MainWriteChannelTimeoutMs) {
-		sonny.needclose = true
+		sonny.setCloseReason("send timeout")
+		sonny.needclose.Store(true)
 		loggo.Error("Outputer processDataFrame timeout sonnny %s %d", f.DataFrame.Id, len(f.DataFrame.Data))
 	}
 	sonny.actived++
+	o.counter.send(sonny, int64(len(f.DataFrame.Data)))
 	loggo.Debug("Outputer processDataFrame %s %d", f.DataFrame.Id, len(f.DataFrame.Data))
 }
 
@@ -97,7 +105,7 @@ func (o *Outputer) processCloseFrame(f *ProxyFrame) {
 	sonny.sendch.Write(f)
 }
 
-func (o *Outputer) open(proxyconn *ProxyConn, targetAddr string) bool {
+func (o *Outputer) open(proxyconn *ProxyConn, targetAddr string, header []byte) bool {
 
 	id := proxyconn.id
 
@@ -108,11 +116,13 @@ func (o *Outputer) open(proxyconn *ProxyConn, targetAddr string) bool {
 	rf.OpenRspFrame = &OpenConnRspFrame{}
 	rf.OpenRspFrame.Id = id
 
-	c, err := network.NewConn(o.conn.Name())
+	c, err := network.NewConn(o.proto)
 	if err != nil {
 		rf.OpenRspFrame.Ret = false
 		rf.OpenRspFrame.Msg = "NewConn fail " + targetAddr
 		o.father.sendch.Write(rf)
+		proxyconn.setCloseReason("open fail " + rf.OpenRspFrame.Msg)
+		o.father.getMetrics().dialFailed()
 		loggo.Error("Outputer open NewConn fail %s %s", targetAddr, err.Error())
 		return false
 	}
@@ -129,15 +139,25 @@ func (o *Outputer) open(proxyconn *ProxyConn, targetAddr string) bool {
 		if err != nil {
 			return err
 		}
+		if len(header) > 0 {
+			_, err = cc.Write(header)
+			if err != nil {
+				cc.Close()
+				return err
+			}
+		}
 		conn = cc
 		return nil
 	})
 
 	err = wg.Wait()
+	proxyconn.opentime = time.Since(proxyconn.begin)
 	if err != nil {
 		rf.OpenRspFrame.Ret = false
 		rf.OpenRspFrame.Msg = "Dial fail " + targetAddr
 		o.father.sendch.Write(rf)
+		proxyconn.setCloseReason("open fail " + rf.OpenRspFrame.Msg)
+		o.father.getMetrics().dialFailed()
 		loggo.Error("Outputer open Dial fail %s %s", targetAddr, err.Error())
 		return false
 	}
@@ -173,6 +193,12 @@ func (o *Outputer) processOpenFrame(f *ProxyFrame) {
 			loggo.Info("Outputer ss no env %s %s", ss_local_host, ss_local_port)
 			return
 		}
+		if f.OpenFrame.Udp {
+			rf.OpenRspFrame.Msg = "ss no udp"
+			o.father.sendch.Write(rf)
+			loggo.Info("Outputer ss no udp %s", id)
+			return
+		}
 		targetAddr = ss_local_host + ":" + ss_local_port
 	}
 
@@ -184,43 +210,82 @@ func (o *Outputer) processOpenFrame(f *ProxyFrame) {
 		return
 	}
 
-	proxyconn := &ProxyConn{id: id, conn: nil, established: true}
-	_, loaded := o.sonny.LoadOrStore(proxyconn.id, proxyconn)
-	if loaded {
+	proxyconn := &ProxyConn{id: id, conn: nil, father: o.father, target: targetAddr, begin: time.Now(),
+		source: f.OpenFrame.Srcaddr, user: f.OpenFrame.User}
+	proxyconn.established.Store(true)
+	if f.OpenFrame.Udp {
+		proxyconn.target = "udp"
+	}
+	if !o.addSonny(proxyconn) {
 		rf.OpenRspFrame.Msg = "Conn id fail"
 		o.father.sendch.Write(rf)
 		loggo.Error("Outputer processOpenFrame LoadOrStore fail %s %s", targetAddr, id)
 		return
 	}
 
-	sendch := common.NewChannel(o.config.ConnBuffer)
+	sendch := common.NewChannel(sonnyConnBuffer(o.config, o.father))
 	recvch := common.NewChannel(o.config.ConnBuffer)
 
 	proxyconn.sendch = sendch
 	proxyconn.recvch = recvch
 
+	if f.OpenFrame.Udp {
+		o.fwg.Go("Outputer processUdpConn"+" "+id, func() error {
+			atomic.AddInt32(&gStateThreadNum.OutputerSonnyThread, 1)
+			defer atomic.AddInt32(&gStateThreadNum.OutputerSonnyThread, -1)
+			return o.processUdpConn(proxyconn)
+		})
+		return
+	}
+
+	var header []byte
+	if len(o.proxyprotocol) > 0 && strings.ToLower(o.proto) == "tcp" {
+		header = makeProxyProtocolHeader(o.proxyprotocol, f.OpenFrame.Srcaddr, f.OpenFrame.Dstaddr)
+	}
+
 	o.fwg.Go("Outputer processProxyConn"+" "+targetAddr, func() error {
 		atomic.AddInt32(&gStateThreadNum.OutputerSonnyThread, 1)
 		defer atomic.AddInt32(&gStateThreadNum.OutputerSonnyThread, -1)
-		return o.processProxyConn(proxyconn, targetAddr)
+		return o.processProxyConn(proxyconn, targetAddr, header)
 	})
 }
 
-func (o *Outputer) processProxyConn(proxyConn *ProxyConn, targetAddr string) error {
+// 对端OPEN打开的连接记在主通道的配额上，结束时减掉
+func (o *Outputer) addSonny(proxyconn *ProxyConn) bool {
+	_, loaded := o.sonny.LoadOrStore(proxyconn.id, proxyconn)
+	if loaded {
+		return false
+	}
+	o.father.quota.addStream(1)
+	return true
+}
+
+func (o *Outputer) deleteSonny(id string) {
+	if _, ok := o.sonny.LoadAndDelete(id); ok {
+		o.father.quota.addStream(-1)
+	}
+}
+
+func (o *Outputer) processProxyConn(proxyConn *ProxyConn, targetAddr string, header []byte) error {
 
 	loggo.Info("Outputer processProxyConn start %s %s", proxyConn.id, targetAddr)
 
 	sendch := proxyConn.sendch
 	recvch := proxyConn.recvch
 
-	if !o.open(proxyConn, targetAddr) {
+	if !o.open(proxyConn, targetAddr, header) {
+		o.deleteSonny(proxyConn.id)
 		sendch.Close()
 		recvch.Close()
+		writeAccessLog(o.config, "outputer", proxyConn, nil)
 		return nil
 	}
 
 	loggo.Info("Outputer processProxyConn open ok %s %s", proxyConn.id, proxyConn.conn.Info())
 
+	o.counter.open(o.father)
+	defer o.counter.close(o.father)
+
 	wg := thread.NewGroup("Outputer processProxyConn"+" "+proxyConn.conn.Info(), o.fwg, func() {
 		loggo.Info("group start exit %s", proxyConn.conn.Info())
 		proxyConn.conn.Close()
@@ -230,11 +295,15 @@ func (o *Outputer) processProxyConn(proxyConn *ProxyConn, targetAddr string) err
 	})
 
 	wg.Go("Outputer recvFromSonny"+" "+proxyConn.conn.Info(), func() error {
-		return recvFromSonny(wg, recvch, proxyConn.conn, o.config.MaxMsgSize)
+		err := recvFromSonny(wg, recvch, proxyConn.conn, o.config.MaxMsgSize)
+		if err == nil && !wg.IsExit() {
+			proxyConn.setCloseReason("local eof")
+		}
+		return err
 	})
 
 	wg.Go("Outputer sendToSonny"+" "+proxyConn.conn.Info(), func() error {
-		return sendToSonny(wg, sendch, proxyConn.conn, o.config.MaxMsgSize)
+		return sendToSonny(wg, sendch, proxyConn, o.config.MaxMsgSize)
 	})
 
 	wg.Go("Outputer checkSonnyActive"+" "+proxyConn.conn.Info(), func() error {
@@ -246,19 +315,97 @@ func (o *Outputer) processProxyConn(proxyConn *ProxyConn, targetAddr string) err
 	})
 
 	wg.Go("Outputer copySonnyRecv"+" "+proxyConn.conn.Info(), func() error {
-		return copySonnyRecv(wg, recvch, proxyConn, o.father)
+		return copySonnyRecv(wg, recvch, proxyConn, o.father, &o.counter)
 	})
 
-	wg.Wait()
-	o.sonny.Delete(proxyConn.id)
+	err := wg.Wait()
+	o.deleteSonny(proxyConn.id)
 
 	closeRemoteConn(proxyConn, o.father)
+	writeAccessLog(o.config, "outputer", proxyConn, err)
 
 	loggo.Info("Outputer processProxyConn end %s %s", proxyConn.id, proxyConn.conn.Info())
 
 	return nil
 }
 
+func (o *Outputer) processUdpConn(proxyConn *ProxyConn) error {
+
+	loggo.Info("Outputer processUdpConn start %s", proxyConn.id)
+
+	sendch := proxyConn.sendch
+	recvch := proxyConn.recvch
+
+	rf := &ProxyFrame{}
+	rf.Type = FRAME_TYPE_OPENRSP
+	rf.OpenRspFrame = &OpenConnRspFrame{}
+	rf.OpenRspFrame.Id = proxyConn.id
+
+	udpconn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		o.deleteSonny(proxyConn.id)
+		sendch.Close()
+		recvch.Close()
+		rf.OpenRspFrame.Ret = false
+		rf.OpenRspFrame.Msg = "ListenUDP fail"
+		o.father.sendch.Write(rf)
+		proxyConn.setCloseReason("open fail " + rf.OpenRspFrame.Msg)
+		writeAccessLog(o.config, "outputer", proxyConn, nil)
+		loggo.Error("Outputer processUdpConn ListenUDP fail %s %s", proxyConn.id, err.Error())
+		return nil
+	}
+
+	proxyConn.conn = newNetConn(udpconn, nil)
+	proxyConn.opentime = time.Since(proxyConn.begin)
+
+	rf.OpenRspFrame.Ret = true
+	rf.OpenRspFrame.Msg = "ok"
+	o.father.sendch.Write(rf)
+
+	loggo.Info("Outputer processUdpConn open ok %s %s", proxyConn.id, proxyConn.conn.Info())
+
+	o.counter.open(o.father)
+	defer o.counter.close(o.father)
+
+	wg := thread.NewGroup("Outputer processUdpConn"+" "+proxyConn.conn.Info(), o.fwg, func() {
+		loggo.Info("group start exit %s", proxyConn.conn.Info())
+		udpconn.Close()
+		sendch.Close()
+		recvch.Close()
+		loggo.Info("group end exit %s", proxyConn.conn.Info())
+	})
+
+	wg.Go("Outputer recvFromUdpTarget"+" "+proxyConn.conn.Info(), func() error {
+		return recvFromUdpTarget(wg, recvch, udpconn, o.config.MaxMsgSize)
+	})
+
+	wg.Go("Outputer sendToUdpTarget"+" "+proxyConn.conn.Info(), func() error {
+		return sendToUdpTarget(wg, sendch, udpconn)
+	})
+
+	wg.Go("Outputer checkSonnyActive"+" "+proxyConn.conn.Info(), func() error {
+		return checkSonnyActive(wg, proxyConn, o.config.EstablishedTimeout, o.config.ConnTimeout)
+	})
+
+	wg.Go("Outputer checkNeedClose"+" "+proxyConn.conn.Info(), func() error {
+		return checkNeedClose(wg, proxyConn)
+	})
+
+	wg.Go("Outputer copySonnyRecv"+" "+proxyConn.conn.Info(), func() error {
+		return copySonnyRecv(wg, recvch, proxyConn, o.father, &o.counter)
+	})
+
+	err = wg.Wait()
+	o.deleteSonny(proxyConn.id)
+
+	closeRemoteConn(proxyConn, o.father)
+	writeAccessLog(o.config, "outputer", proxyConn, err)
+
+	loggo.Info("Outputer processUdpConn end %s %s", proxyConn.id, proxyConn.conn.Info())
+
+	return nil
+}
+
 func (o *Outputer) sonnySize() int {
 	size := 0
 	o.sonny.Range(func(key, value interface{}) bool {
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 一个范围展开成这么多条隧道，每条都要监听，太大了占满端口和文件句柄
+const maxPortRangeSize = 1000
+
+// 解析 host:30000-30100 这样的端口范围，单个端口时begin等于end
+func parsePortRange(addr string) (string, int, int, error) {
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	beginstr, endstr, ok := strings.Cut(portstr, "-")
+	if !ok {
+		endstr = beginstr
+	}
+
+	begin, err := strconv.Atoi(beginstr)
+	if err != nil {
+		return "", 0, 0, errors.New("error port " + addr)
+	}
+	end, err := strconv.Atoi(endstr)
+	if err != nil {
+		return "", 0, 0, errors.New("error port " + addr)
+	}
+	if begin < 1 || end > 65535 || begin > end {
+		return "", 0, 0, errors.New("error port range " + addr)
+	}
+	if end-begin+1 > maxPortRangeSize {
+		return "", 0, 0, errors.New("port range too large " + addr + ", max " + strconv.Itoa(maxPortRangeSize))
+	}
+	return host, begin, end, nil
+}
+
+func isPortRange(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && strings.Contains(port, "-")
+}
+
+// 把端口范围展开成一一对应的监听地址和目标地址
+func splitPortRange(fromaddr string, toaddr string) ([]string, []string, error) {
+	if !isPortRange(fromaddr) && !isPortRange(toaddr) {
+		return []string{fromaddr}, []string{toaddr}, nil
+	}
+
+	fromhost, frombegin, fromend, err := parsePortRange(fromaddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	tohost, tobegin, toend, err := parsePortRange(toaddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fromend-frombegin != toend-tobegin {
+		return nil, nil, errors.New("port range size not equal " + fromaddr + " " + toaddr)
+	}
+
+	var froms []string
+	var tos []string
+	for i := 0; i <= fromend-frombegin; i++ {
+		froms = append(froms, net.JoinHostPort(fromhost, strconv.Itoa(frombegin+i)))
+		tos = append(tos, net.JoinHostPort(tohost, strconv.Itoa(tobegin+i)))
+	}
+	return froms, tos, nil
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// 每个端口回自己的端口号，用来确认映射到了对应的目标端口
+// 回自己的端口号，连接由对端关闭，服务组的成员上连接数能累计
+func startPortServer(t *testing.T, port int) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write([]byte(strconv.Itoa(port)))
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+// 测试用的端口都是5位
+func readPortServer(addr string) (int, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(b))
+}
+
+func tryPortServer(addr string, port int) error {
+	n, err := readPortServer(addr)
+	if err != nil {
+		return err
+	}
+	if n != port {
+		return echoError("port mismatch " + addr + " " + strconv.Itoa(n))
+	}
+	return nil
+}
+
+func checkPortRange(from int, to int, size int, timeout time.Duration) error {
+	for i := 0; i < size; i++ {
+		var err error
+		begin := time.Now()
+		for time.Since(begin) < timeout {
+			err = tryPortServer("127.0.0.1:"+strconv.Itoa(from+i), to+i)
+			if err == nil {
+				break
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Test0009PortRange(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	if _, _, err := splitPortRange(":30000-30100", ":40000-40099"); err == nil {
+		t.Fatal("port range size not equal should fail")
+	}
+	if _, _, err := splitPortRange(":30100-30000", ":40100-40000"); err == nil {
+		t.Fatal("port range reverse should fail")
+	}
+	if _, _, err := splitPortRange(":0-10", ":40000-40010"); err == nil {
+		t.Fatal("port 0 should fail")
+	}
+	if _, _, err := splitPortRange(":1-65535", ":1-65535"); err == nil {
+		t.Fatal("port range too large should fail")
+	}
+	froms, tos, err := splitPortRange("my-host:30000", "other-host:40000")
+	if err != nil || len(froms) != 1 || froms[0] != "my-host:30000" || tos[0] != "other-host:40000" {
+		t.Fatal("single port", froms, tos, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		l := startPortServer(t, 32610+i)
+		defer l.Close()
+	}
+
+	config := DefaultConfig()
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:32600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := NewClient(config, "tcp", "127.0.0.1:32600", "test_port_range", "PROXY", []string{"tcp"}, []string{"127.0.0.1:32601-32603"}, []string{"127.0.0.1:32610-32612"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := checkPortRange(32601, 32610, 3, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := NewClient(config, "tcp", "127.0.0.1:32600", "test_reverse_port_range", "REVERSE_PROXY", []string{"tcp"}, []string{"127.0.0.1:32604-32606"}, []string{"127.0.0.1:32610-32612"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	if err := checkPortRange(32604, 32610, 3, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -29,6 +29,8 @@ const (
 	PROXY_PROTO_RUDP  PROXY_PROTO = 2
 	PROXY_PROTO_RICMP PROXY_PROTO = 3
 	PROXY_PROTO_KCP   PROXY_PROTO = 4
+	PROXY_PROTO_QUIC  PROXY_PROTO = 5
+	PROXY_PROTO_RHTTP PROXY_PROTO = 6
 )
 
 // Enum value maps for PROXY_PROTO.
@@ -39,6 +41,8 @@ var (
 		2: "RUDP",
 		3: "RICMP",
 		4: "KCP",
+		5: "QUIC",
+		6: "RHTTP",
 	}
 	PROXY_PROTO_value = map[string]int32{
 		"TCP":   0,
@@ -46,6 +50,8 @@ var (
 		"RUDP":  2,
 		"RICMP": 3,
 		"KCP":   4,
+		"QUIC":  5,
+		"RHTTP": 6,
 	}
 )
 
@@ -89,6 +95,16 @@ const (
 	CLIENT_TYPE_REVERSE_SOCKS5 CLIENT_TYPE = 3
 	// client fromaddr -> server shadowsocks address [SS_LOCAL_HOST:SS_LOCAL_PORT]
 	CLIENT_TYPE_SS_PROXY CLIENT_TYPE = 4
+	// client fromaddr -> server, http proxy
+	CLIENT_TYPE_HTTP_PROXY CLIENT_TYPE = 5
+	// server fromaddr -> client, http proxy
+	CLIENT_TYPE_REVERSE_HTTP_PROXY CLIENT_TYPE = 6
+	// client iptables redirect/tproxy -> server original destination
+	CLIENT_TYPE_TRANSPARENT CLIENT_TYPE = 7
+	// client toaddr registered as secret service [fromaddr] on server, no server listen
+	CLIENT_TYPE_SECRET CLIENT_TYPE = 8
+	// client fromaddr -> server -> secret service client [toaddr]
+	CLIENT_TYPE_SECRET_VISITOR CLIENT_TYPE = 9
 )
 
 // Enum value maps for CLIENT_TYPE.
@@ -99,13 +115,23 @@ var (
 		2: "SOCKS5",
 		3: "REVERSE_SOCKS5",
 		4: "SS_PROXY",
+		5: "HTTP_PROXY",
+		6: "REVERSE_HTTP_PROXY",
+		7: "TRANSPARENT",
+		8: "SECRET",
+		9: "SECRET_VISITOR",
 	}
 	CLIENT_TYPE_value = map[string]int32{
-		"PROXY":          0,
-		"REVERSE_PROXY":  1,
-		"SOCKS5":         2,
-		"REVERSE_SOCKS5": 3,
-		"SS_PROXY":       4,
+		"PROXY":              0,
+		"REVERSE_PROXY":      1,
+		"SOCKS5":             2,
+		"REVERSE_SOCKS5":     3,
+		"SS_PROXY":           4,
+		"HTTP_PROXY":         5,
+		"REVERSE_HTTP_PROXY": 6,
+		"TRANSPARENT":        7,
+		"SECRET":             8,
+		"SECRET_VISITOR":     9,
 	}
 )
 
@@ -147,6 +173,7 @@ const (
 	FRAME_TYPE_OPEN     FRAME_TYPE = 5
 	FRAME_TYPE_OPENRSP  FRAME_TYPE = 6
 	FRAME_TYPE_CLOSE    FRAME_TYPE = 7
+	FRAME_TYPE_GOAWAY   FRAME_TYPE = 8
 )
 
 // Enum value maps for FRAME_TYPE.
@@ -160,6 +187,7 @@ var (
 		5: "OPEN",
 		6: "OPENRSP",
 		7: "CLOSE",
+		8: "GOAWAY",
 	}
 	FRAME_TYPE_value = map[string]int32{
 		"LOGIN":    0,
@@ -170,6 +198,7 @@ var (
 		"OPEN":     5,
 		"OPENRSP":  6,
 		"CLOSE":    7,
+		"GOAWAY":   8,
 	}
 )
 
@@ -201,13 +230,27 @@ func (FRAME_TYPE) EnumDescriptor() ([]byte, []int) {
 }
 
 type LoginFrame struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Proxyproto    PROXY_PROTO            `protobuf:"varint,1,opt,name=proxyproto,proto3,enum=PROXY_PROTO" json:"proxyproto,omitempty"`
-	Clienttype    CLIENT_TYPE            `protobuf:"varint,2,opt,name=clienttype,proto3,enum=CLIENT_TYPE" json:"clienttype,omitempty"`
-	Fromaddr      string                 `protobuf:"bytes,3,opt,name=fromaddr,proto3" json:"fromaddr,omitempty"`
-	Toaddr        string                 `protobuf:"bytes,4,opt,name=toaddr,proto3" json:"toaddr,omitempty"`
-	Name          string                 `protobuf:"bytes,5,opt,name=name,proto3" json:"name,omitempty"`
-	Key           string                 `protobuf:"bytes,6,opt,name=key,proto3" json:"key,omitempty"`
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	Proxyproto PROXY_PROTO            `protobuf:"varint,1,opt,name=proxyproto,proto3,enum=PROXY_PROTO" json:"proxyproto,omitempty"`
+	Clienttype CLIENT_TYPE            `protobuf:"varint,2,opt,name=clienttype,proto3,enum=CLIENT_TYPE" json:"clienttype,omitempty"`
+	Fromaddr   string                 `protobuf:"bytes,3,opt,name=fromaddr,proto3" json:"fromaddr,omitempty"`
+	Toaddr     string                 `protobuf:"bytes,4,opt,name=toaddr,proto3" json:"toaddr,omitempty"`
+	Name       string                 `protobuf:"bytes,5,opt,name=name,proto3" json:"name,omitempty"`
+	Key        string                 `protobuf:"bytes,6,opt,name=key,proto3" json:"key,omitempty"`
+	// reverse proxy service group, members share the same fromaddr
+	Group string `protobuf:"bytes,7,opt,name=group,proto3" json:"group,omitempty"`
+	// group balance: round_robin least_conn
+	Balance string `protobuf:"bytes,8,opt,name=balance,proto3" json:"balance,omitempty"`
+	// secret service and visitor share the same secret
+	Secret string `protobuf:"bytes,9,opt,name=secret,proto3" json:"secret,omitempty"`
+	// socks5 client egress through this connected client instead of server
+	Exit string `protobuf:"bytes,10,opt,name=exit,proto3" json:"exit,omitempty"`
+	// outputer write proxy protocol header to target: v1 v2
+	Proxyprotocol string `protobuf:"bytes,11,opt,name=proxyprotocol,proto3" json:"proxyprotocol,omitempty"`
+	// reverse socks5/http proxy client lets socks5 clients egress through it
+	Allowexit bool `protobuf:"varint,12,opt,name=allowexit,proto3" json:"allowexit,omitempty"`
+	// exit client and socks5 client share the same exit secret
+	Exitsecret    string `protobuf:"bytes,13,opt,name=exitsecret,proto3" json:"exitsecret,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -284,6 +327,55 @@ func (x *LoginFrame) GetKey() string {
 	return ""
 }
 
+func (x *LoginFrame) GetGroup() string {
+	if x != nil {
+		return x.Group
+	}
+	return ""
+}
+
+func (x *LoginFrame) GetBalance() string {
+	if x != nil {
+		return x.Balance
+	}
+	return ""
+}
+
+func (x *LoginFrame) GetSecret() string {
+	if x != nil {
+		return x.Secret
+	}
+	return ""
+}
+
+func (x *LoginFrame) GetExit() string {
+	if x != nil {
+		return x.Exit
+	}
+	return ""
+}
+
+func (x *LoginFrame) GetProxyprotocol() string {
+	if x != nil {
+		return x.Proxyprotocol
+	}
+	return ""
+}
+
+func (x *LoginFrame) GetAllowexit() bool {
+	if x != nil {
+		return x.Allowexit
+	}
+	return false
+}
+
+func (x *LoginFrame) GetExitsecret() string {
+	if x != nil {
+		return x.Exitsecret
+	}
+	return ""
+}
+
 type LoginRspFrame struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Ret           bool                   `protobuf:"varint,1,opt,name=ret,proto3" json:"ret,omitempty"`
@@ -425,9 +517,16 @@ func (x *PongFrame) GetTime() int64 {
 }
 
 type OpenConnFrame struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Toaddr        string                 `protobuf:"bytes,2,opt,name=toaddr,proto3" json:"toaddr,omitempty"`
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Id     string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Toaddr string                 `protobuf:"bytes,2,opt,name=toaddr,proto3" json:"toaddr,omitempty"`
+	// socks5 udp associate
+	Udp bool `protobuf:"varint,3,opt,name=udp,proto3" json:"udp,omitempty"`
+	// original remote and local address of the accepted conn, for proxy protocol
+	Srcaddr string `protobuf:"bytes,4,opt,name=srcaddr,proto3" json:"srcaddr,omitempty"`
+	Dstaddr string `protobuf:"bytes,5,opt,name=dstaddr,proto3" json:"dstaddr,omitempty"`
+	// socks user of the accepted conn, for access log
+	User          string `protobuf:"bytes,6,opt,name=user,proto3" json:"user,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -476,6 +575,34 @@ func (x *OpenConnFrame) GetToaddr() string {
 	return ""
 }
 
+func (x *OpenConnFrame) GetUdp() bool {
+	if x != nil {
+		return x.Udp
+	}
+	return false
+}
+
+func (x *OpenConnFrame) GetSrcaddr() string {
+	if x != nil {
+		return x.Srcaddr
+	}
+	return ""
+}
+
+func (x *OpenConnFrame) GetDstaddr() string {
+	if x != nil {
+		return x.Dstaddr
+	}
+	return ""
+}
+
+func (x *OpenConnFrame) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
 type OpenConnRspFrame struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
@@ -581,12 +708,14 @@ func (x *CloseFrame) GetId() string {
 }
 
 type DataFrame struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Compress      bool                   `protobuf:"varint,2,opt,name=compress,proto3" json:"compress,omitempty"`
-	Crc           string                 `protobuf:"bytes,3,opt,name=crc,proto3" json:"crc,omitempty"`
-	Data          []byte                 `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
-	Index         int32                  `protobuf:"varint,5,opt,name=index,proto3" json:"index,omitempty"`
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Id       string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Compress bool                   `protobuf:"varint,2,opt,name=compress,proto3" json:"compress,omitempty"`
+	Crc      string                 `protobuf:"bytes,3,opt,name=crc,proto3" json:"crc,omitempty"`
+	Data     []byte                 `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	Index    int32                  `protobuf:"varint,5,opt,name=index,proto3" json:"index,omitempty"`
+	// udp datagram target or source address
+	Addr          string `protobuf:"bytes,6,opt,name=addr,proto3" json:"addr,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -656,6 +785,73 @@ func (x *DataFrame) GetIndex() int32 {
 	return 0
 }
 
+func (x *DataFrame) GetAddr() string {
+	if x != nil {
+		return x.Addr
+	}
+	return ""
+}
+
+type GoawayFrame struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Msg           string                 `protobuf:"bytes,1,opt,name=msg,proto3" json:"msg,omitempty"`
+	Proto         string                 `protobuf:"bytes,2,opt,name=proto,proto3" json:"proto,omitempty"`
+	Addr          string                 `protobuf:"bytes,3,opt,name=addr,proto3" json:"addr,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GoawayFrame) Reset() {
+	*x = GoawayFrame{}
+	mi := &file_proxy_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GoawayFrame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GoawayFrame) ProtoMessage() {}
+
+func (x *GoawayFrame) ProtoReflect() protoreflect.Message {
+	mi := &file_proxy_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GoawayFrame.ProtoReflect.Descriptor instead.
+func (*GoawayFrame) Descriptor() ([]byte, []int) {
+	return file_proxy_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *GoawayFrame) GetMsg() string {
+	if x != nil {
+		return x.Msg
+	}
+	return ""
+}
+
+func (x *GoawayFrame) GetProto() string {
+	if x != nil {
+		return x.Proto
+	}
+	return ""
+}
+
+func (x *GoawayFrame) GetAddr() string {
+	if x != nil {
+		return x.Addr
+	}
+	return ""
+}
+
 type ProxyFrame struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Type          FRAME_TYPE             `protobuf:"varint,1,opt,name=type,proto3,enum=FRAME_TYPE" json:"type,omitempty"`
@@ -667,13 +863,14 @@ type ProxyFrame struct {
 	OpenFrame     *OpenConnFrame         `protobuf:"bytes,7,opt,name=openFrame,proto3" json:"openFrame,omitempty"`
 	OpenRspFrame  *OpenConnRspFrame      `protobuf:"bytes,8,opt,name=openRspFrame,proto3" json:"openRspFrame,omitempty"`
 	CloseFrame    *CloseFrame            `protobuf:"bytes,9,opt,name=closeFrame,proto3" json:"closeFrame,omitempty"`
+	GoawayFrame   *GoawayFrame           `protobuf:"bytes,10,opt,name=goawayFrame,proto3" json:"goawayFrame,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *ProxyFrame) Reset() {
 	*x = ProxyFrame{}
-	mi := &file_proxy_proto_msgTypes[8]
+	mi := &file_proxy_proto_msgTypes[9]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -685,7 +882,7 @@ func (x *ProxyFrame) String() string {
 func (*ProxyFrame) ProtoMessage() {}
 
 func (x *ProxyFrame) ProtoReflect() protoreflect.Message {
-	mi := &file_proxy_proto_msgTypes[8]
+	mi := &file_proxy_proto_msgTypes[9]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -698,7 +895,7 @@ func (x *ProxyFrame) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ProxyFrame.ProtoReflect.Descriptor instead.
 func (*ProxyFrame) Descriptor() ([]byte, []int) {
-	return file_proxy_proto_rawDescGZIP(), []int{8}
+	return file_proxy_proto_rawDescGZIP(), []int{9}
 }
 
 func (x *ProxyFrame) GetType() FRAME_TYPE {
@@ -764,11 +961,18 @@ func (x *ProxyFrame) GetCloseFrame() *CloseFrame {
 	return nil
 }
 
+func (x *ProxyFrame) GetGoawayFrame() *GoawayFrame {
+	if x != nil {
+		return x.GoawayFrame
+	}
+	return nil
+}
+
 var File_proxy_proto protoreflect.FileDescriptor
 
 const file_proxy_proto_rawDesc = "" +
 	"\n" +
-	"\vproxy.proto\"\xc2\x01\n" +
+	"\vproxy.proto\"\x82\x03\n" +
 	"\n" +
 	"LoginFrame\x12,\n" +
 	"\n" +
@@ -780,30 +984,49 @@ const file_proxy_proto_rawDesc = "" +
 	"\bfromaddr\x18\x03 \x01(\tR\bfromaddr\x12\x16\n" +
 	"\x06toaddr\x18\x04 \x01(\tR\x06toaddr\x12\x12\n" +
 	"\x04name\x18\x05 \x01(\tR\x04name\x12\x10\n" +
-	"\x03key\x18\x06 \x01(\tR\x03key\"3\n" +
+	"\x03key\x18\x06 \x01(\tR\x03key\x12\x14\n" +
+	"\x05group\x18\a \x01(\tR\x05group\x12\x18\n" +
+	"\abalance\x18\b \x01(\tR\abalance\x12\x16\n" +
+	"\x06secret\x18\t \x01(\tR\x06secret\x12\x12\n" +
+	"\x04exit\x18\n" +
+	" \x01(\tR\x04exit\x12$\n" +
+	"\rproxyprotocol\x18\v \x01(\tR\rproxyprotocol\x12\x1c\n" +
+	"\tallowexit\x18\f \x01(\bR\tallowexit\x12\x1e\n" +
+	"\n" +
+	"exitsecret\x18\r \x01(\tR\n" +
+	"exitsecret\"3\n" +
 	"\rLoginRspFrame\x12\x10\n" +
 	"\x03ret\x18\x01 \x01(\bR\x03ret\x12\x10\n" +
 	"\x03msg\x18\x02 \x01(\tR\x03msg\"\x1f\n" +
 	"\tPingFrame\x12\x12\n" +
 	"\x04time\x18\x01 \x01(\x03R\x04time\"\x1f\n" +
 	"\tPongFrame\x12\x12\n" +
-	"\x04time\x18\x01 \x01(\x03R\x04time\"7\n" +
+	"\x04time\x18\x01 \x01(\x03R\x04time\"\x91\x01\n" +
 	"\rOpenConnFrame\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
-	"\x06toaddr\x18\x02 \x01(\tR\x06toaddr\"F\n" +
+	"\x06toaddr\x18\x02 \x01(\tR\x06toaddr\x12\x10\n" +
+	"\x03udp\x18\x03 \x01(\bR\x03udp\x12\x18\n" +
+	"\asrcaddr\x18\x04 \x01(\tR\asrcaddr\x12\x18\n" +
+	"\adstaddr\x18\x05 \x01(\tR\adstaddr\x12\x12\n" +
+	"\x04user\x18\x06 \x01(\tR\x04user\"F\n" +
 	"\x10OpenConnRspFrame\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x10\n" +
 	"\x03ret\x18\x02 \x01(\bR\x03ret\x12\x10\n" +
 	"\x03msg\x18\x03 \x01(\tR\x03msg\"\x1c\n" +
 	"\n" +
 	"CloseFrame\x12\x0e\n" +
-	"\x02id\x18\x01 \x01(\tR\x02id\"s\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"\x87\x01\n" +
 	"\tDataFrame\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x1a\n" +
 	"\bcompress\x18\x02 \x01(\bR\bcompress\x12\x10\n" +
 	"\x03crc\x18\x03 \x01(\tR\x03crc\x12\x12\n" +
 	"\x04data\x18\x04 \x01(\fR\x04data\x12\x14\n" +
-	"\x05index\x18\x05 \x01(\x05R\x05index\"\xa0\x03\n" +
+	"\x05index\x18\x05 \x01(\x05R\x05index\x12\x12\n" +
+	"\x04addr\x18\x06 \x01(\tR\x04addr\"I\n" +
+	"\vGoawayFrame\x12\x10\n" +
+	"\x03msg\x18\x01 \x01(\tR\x03msg\x12\x14\n" +
+	"\x05proto\x18\x02 \x01(\tR\x05proto\x12\x12\n" +
+	"\x04addr\x18\x03 \x01(\tR\x04addr\"\xd0\x03\n" +
 	"\n" +
 	"ProxyFrame\x12\x1f\n" +
 	"\x04type\x18\x01 \x01(\x0e2\v.FRAME_TYPER\x04type\x12+\n" +
@@ -821,20 +1044,31 @@ const file_proxy_proto_rawDesc = "" +
 	"\fopenRspFrame\x18\b \x01(\v2\x11.OpenConnRspFrameR\fopenRspFrame\x12+\n" +
 	"\n" +
 	"closeFrame\x18\t \x01(\v2\v.CloseFrameR\n" +
-	"closeFrame*=\n" +
+	"closeFrame\x12.\n" +
+	"\vgoawayFrame\x18\n" +
+	" \x01(\v2\f.GoawayFrameR\vgoawayFrame*R\n" +
 	"\vPROXY_PROTO\x12\a\n" +
 	"\x03TCP\x10\x00\x12\a\n" +
 	"\x03UDP\x10\x01\x12\b\n" +
 	"\x04RUDP\x10\x02\x12\t\n" +
 	"\x05RICMP\x10\x03\x12\a\n" +
-	"\x03KCP\x10\x04*Y\n" +
+	"\x03KCP\x10\x04\x12\b\n" +
+	"\x04QUIC\x10\x05\x12\t\n" +
+	"\x05RHTTP\x10\x06*\xb2\x01\n" +
 	"\vCLIENT_TYPE\x12\t\n" +
 	"\x05PROXY\x10\x00\x12\x11\n" +
 	"\rREVERSE_PROXY\x10\x01\x12\n" +
 	"\n" +
 	"\x06SOCKS5\x10\x02\x12\x12\n" +
 	"\x0eREVERSE_SOCKS5\x10\x03\x12\f\n" +
-	"\bSS_PROXY\x10\x04*e\n" +
+	"\bSS_PROXY\x10\x04\x12\x0e\n" +
+	"\n" +
+	"HTTP_PROXY\x10\x05\x12\x16\n" +
+	"\x12REVERSE_HTTP_PROXY\x10\x06\x12\x0f\n" +
+	"\vTRANSPARENT\x10\a\x12\n" +
+	"\n" +
+	"\x06SECRET\x10\b\x12\x12\n" +
+	"\x0eSECRET_VISITOR\x10\t*q\n" +
 	"\n" +
 	"FRAME_TYPE\x12\t\n" +
 	"\x05LOGIN\x10\x00\x12\f\n" +
@@ -844,7 +1078,9 @@ const file_proxy_proto_rawDesc = "" +
 	"\x04PONG\x10\x04\x12\b\n" +
 	"\x04OPEN\x10\x05\x12\v\n" +
 	"\aOPENRSP\x10\x06\x12\t\n" +
-	"\x05CLOSE\x10\aB\n" +
+	"\x05CLOSE\x10\a\x12\n" +
+	"\n" +
+	"\x06GOAWAY\x10\bB\n" +
 	"Z\b./;proxyb\x06proto3"
 
 var (
@@ -860,7 +1096,7 @@ func file_proxy_proto_rawDescGZIP() []byte {
 }
 
 var file_proxy_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
-var file_proxy_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_proxy_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
 var file_proxy_proto_goTypes = []any{
 	(PROXY_PROTO)(0),         // 0: PROXY_PROTO
 	(CLIENT_TYPE)(0),         // 1: CLIENT_TYPE
@@ -873,7 +1109,8 @@ var file_proxy_proto_goTypes = []any{
 	(*OpenConnRspFrame)(nil), // 8: OpenConnRspFrame
 	(*CloseFrame)(nil),       // 9: CloseFrame
 	(*DataFrame)(nil),        // 10: DataFrame
-	(*ProxyFrame)(nil),       // 11: ProxyFrame
+	(*GoawayFrame)(nil),      // 11: GoawayFrame
+	(*ProxyFrame)(nil),       // 12: ProxyFrame
 }
 var file_proxy_proto_depIdxs = []int32{
 	0,  // 0: LoginFrame.proxyproto:type_name -> PROXY_PROTO
@@ -887,11 +1124,12 @@ var file_proxy_proto_depIdxs = []int32{
 	7,  // 8: ProxyFrame.openFrame:type_name -> OpenConnFrame
 	8,  // 9: ProxyFrame.openRspFrame:type_name -> OpenConnRspFrame
 	9,  // 10: ProxyFrame.closeFrame:type_name -> CloseFrame
-	11, // [11:11] is the sub-list for method output_type
-	11, // [11:11] is the sub-list for method input_type
-	11, // [11:11] is the sub-list for extension type_name
-	11, // [11:11] is the sub-list for extension extendee
-	0,  // [0:11] is the sub-list for field type_name
+	11, // 11: ProxyFrame.goawayFrame:type_name -> GoawayFrame
+	12, // [12:12] is the sub-list for method output_type
+	12, // [12:12] is the sub-list for method input_type
+	12, // [12:12] is the sub-list for extension type_name
+	12, // [12:12] is the sub-list for extension extendee
+	0,  // [0:12] is the sub-list for field type_name
 }
 
 func init() { file_proxy_proto_init() }
@@ -905,7 +1143,7 @@ func file_proxy_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proxy_proto_rawDesc), len(file_proxy_proto_rawDesc)),
 			NumEnums:      3,
-			NumMessages:   9,
+			NumMessages:   10,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/network"
+)
+
+func startEcho(t *testing.T, proto string, addr string) network.Conn {
+	c, err := network.NewConn(proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := c.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func checkEcho(proto string, addr string, timeout time.Duration) error {
+	var err error
+	begin := time.Now()
+	for time.Since(begin) < timeout {
+		err = tryEcho(proto, addr)
+		if err == nil {
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return err
+}
+
+func tryEcho(proto string, addr string) error {
+	c, err := network.NewConn(proto)
+	if err != nil {
+		return err
+	}
+	conn, err := c.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	src := []byte("hello spp " + proto + " " + addr)
+	if _, err := conn.Write(src); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		dst := make([]byte, len(src))
+		n := 0
+		for n < len(dst) {
+			nn, err := conn.Read(dst[n:])
+			if err != nil {
+				done <- err
+				return
+			}
+			n += nn
+		}
+		if !bytes.Equal(src, dst) {
+			done <- errEchoMismatch
+			return
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(2 * time.Second):
+		return errEchoTimeout
+	}
+}
+
+type echoError string
+
+func (e echoError) Error() string { return string(e) }
+
+const (
+	errEchoMismatch = echoError("echo mismatch")
+	errEchoTimeout  = echoError("echo timeout")
+)
+
+func Test0002AllProxyProto(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	for _, p := range network.SupportProtos() {
+		if _, ok := PROXY_PROTO_value[strings.ToUpper(p)]; !ok {
+			t.Fatalf("no PROXY_PROTO %s", p)
+		}
+	}
+
+	// ricmp 需要 root 权限并会与同进程的其他 icmp 监听互相干扰，这里不做全组合测试
+	var protos []string
+	for _, p := range network.SupportReliableProtos() {
+		if p != "ricmp" {
+			protos = append(protos, p)
+		}
+	}
+	var proxyprotos []string
+	for _, p := range network.SupportProtos() {
+		if p != "ricmp" {
+			proxyprotos = append(proxyprotos, p)
+		}
+	}
+
+	port := 31000
+	for _, mp := range protos {
+		for _, pp := range proxyprotos {
+			mp, pp := mp, pp
+			listenaddr := "127.0.0.1:" + strconv.Itoa(port)
+			fromaddr := "127.0.0.1:" + strconv.Itoa(port+1)
+			toaddr := "127.0.0.1:" + strconv.Itoa(port+2)
+			port += 3
+
+			t.Run(mp+"-"+pp, func(t *testing.T) {
+				echo := startEcho(t, pp, toaddr)
+				defer echo.Close()
+
+				config := DefaultConfig()
+				s, err := NewServer(config, []string{mp}, []string{listenaddr})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+
+				c, err := NewClient(config, mp, listenaddr, "test", "PROXY", []string{pp}, []string{fromaddr}, []string{toaddr})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+
+				if err := checkEcho(pp, fromaddr, 15*time.Second); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/network"
+)
+
+// HAProxy PROXY protocol，让隧道后面的服务拿到真实的来源地址
+const (
+	PROXY_PROTOCOL_V1 = "v1"
+	PROXY_PROTOCOL_V2 = "v2"
+)
+
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func checkProxyProtocol(version string) error {
+	if version != "" && version != PROXY_PROTOCOL_V1 && version != PROXY_PROTOCOL_V2 {
+		return errors.New("error proxy protocol " + version)
+	}
+	return nil
+}
+
+// 取连接两端的地址，拿不到的返回空
+func connAddrs(conn network.Conn) (string, string) {
+	c, ok := conn.(interface {
+		LocalAddr() net.Addr
+		RemoteAddr() net.Addr
+	})
+	if !ok || c.LocalAddr() == nil || c.RemoteAddr() == nil {
+		return "", ""
+	}
+	if _, ok := c.RemoteAddr().(*net.TCPAddr); !ok {
+		return "", ""
+	}
+	return c.RemoteAddr().String(), c.LocalAddr().String()
+}
+
+func splitTcpAddr(addr string) (net.IP, int, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, false
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil || p < 0 || p > 65535 {
+		return nil, 0, false
+	}
+	return ip, p, true
+}
+
+func makeProxyProtocolHeader(version string, srcaddr string, dstaddr string) []byte {
+	srcip, srcport, srcok := splitTcpAddr(srcaddr)
+	dstip, dstport, dstok := splitTcpAddr(dstaddr)
+	known := srcok && dstok
+
+	// 两端地址族不一样时都按v6写
+	v4 := known && srcip.To4() != nil && dstip.To4() != nil
+	if v4 {
+		srcip = srcip.To4()
+		dstip = dstip.To4()
+	} else if known {
+		srcip = srcip.To16()
+		dstip = dstip.To16()
+	}
+
+	if version == PROXY_PROTOCOL_V1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		src := srcip.String()
+		dst := dstip.String()
+		if !v4 {
+			// v4映射的地址也要写成v6的格式
+			family = "TCP6"
+			src = netip.AddrFrom16([16]byte(srcip)).String()
+			dst = netip.AddrFrom16([16]byte(dstip)).String()
+		}
+		return []byte("PROXY " + family + " " + src + " " + dst + " " +
+			strconv.Itoa(srcport) + " " + strconv.Itoa(dstport) + "\r\n")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolV2Sig)
+	if !known {
+		// LOCAL命令，接收方使用连接本身的地址
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	buf.WriteByte(0x21)
+	if v4 {
+		buf.WriteByte(0x11)
+	} else {
+		buf.WriteByte(0x21)
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(srcip)+4))
+	buf.Write(srcip)
+	buf.Write(dstip)
+	binary.Write(&buf, binary.BigEndian, uint16(srcport))
+	binary.Write(&buf, binary.BigEndian, uint16(dstport))
+	return buf.Bytes()
+}
+
+// v1的头最长107字节
+const proxyProtocolV1MaxLen = 107
+
+// 读PROXY protocol头，返回真实来源地址，UNKNOWN和LOCAL返回nil
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	sig, err := reader.Peek(len(proxyProtocolV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyProtocolV2Sig) {
+		return readProxyProtocolV2(reader)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyProtocolV1(reader)
+	}
+	return nil, errors.New("no proxy protocol header")
+}
+
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLen {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy protocol v1 header too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("proxy protocol v1 header error " + string(line))
+	}
+	srcip, srcport, ok := splitTcpAddr(net.JoinHostPort(fields[2], fields[4]))
+	if !ok {
+		return nil, errors.New("proxy protocol v1 src error " + string(line))
+	}
+	if _, _, ok := splitTcpAddr(net.JoinHostPort(fields[3], fields[5])); !ok {
+		return nil, errors.New("proxy protocol v1 dst error " + string(line))
+	}
+	return &net.TCPAddr{IP: srcip, Port: srcport}, nil
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("proxy protocol v2 version error")
+	}
+	cmd := header[12] & 0x0f
+	family := header[13]
+	addr := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	_, err = io.ReadFull(reader, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd == 0x00 {
+		return nil, nil
+	}
+	if cmd != 0x01 {
+		return nil, errors.New("proxy protocol v2 command error")
+	}
+
+	// 后面可能还有TLV，不用管
+	switch family >> 4 {
+	case 0x1:
+		if len(addr) < 12 {
+			return nil, errors.New("proxy protocol v2 ipv4 addr error")
+		}
+		return &net.TCPAddr{IP: net.IP(addr[0:4]), Port: int(binary.BigEndian.Uint16(addr[8:]))}, nil
+	case 0x2:
+		if len(addr) < 36 {
+			return nil, errors.New("proxy protocol v2 ipv6 addr error")
+		}
+		return &net.TCPAddr{IP: net.IP(addr[0:16]), Port: int(binary.BigEndian.Uint16(addr[32:]))}, nil
+	}
+	return nil, nil
+}
+
+// 可以发PROXY protocol头的负载均衡地址，单个ip或者CIDR
+func parseTrustedProxies(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, errors.New("error trusted proxy " + s)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		} else {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, errors.New("error trusted proxy " + s)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return prefixes, nil
+}
+
+// 接受PROXY protocol时必须指定信任的来源，否则谁都能伪造来源地址
+func checkTrustedProxies(config *Config) error {
+	if !config.AcceptProxyProtocol {
+		return nil
+	}
+	prefixes, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	if len(prefixes) <= 0 {
+		return errors.New("accept proxy protocol need trusted proxies")
+	}
+	return nil
+}
+
+func isTrustedProxy(config *Config, addr net.Addr) bool {
+	tcpaddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcpaddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	prefixes, _ := parseTrustedProxies(config.TrustedProxies)
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 监听端口在L4负载均衡后面时，先读掉PROXY protocol头，后面日志等都用里面的真实来源地址
+func acceptProxyProtocol(conn network.Conn, config *Config) bool {
+	nc, ok := conn.(*netConn)
+	if !config.AcceptProxyProtocol || !ok {
+		return true
+	}
+
+	// 不是负载均衡来的连接直接断开，不读它的头
+	if !isTrustedProxy(config, nc.conn.RemoteAddr()) {
+		loggo.Error("acceptProxyProtocol untrusted %s", conn.Info())
+		conn.Close()
+		return false
+	}
+
+	nc.conn.SetReadDeadline(time.Now().Add(time.Duration(config.EstablishedTimeout) * time.Second))
+	reader := bufio.NewReader(nc.reader)
+	src, err := readProxyProtocolHeader(reader)
+	nc.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		loggo.Error("acceptProxyProtocol fail %s %s", conn.Info(), err)
+		conn.Close()
+		return false
+	}
+
+	nc.reader = reader
+	if src != nil {
+		nc.remote = src
+		nc.info = ""
+	}
+	loggo.Info("acceptProxyProtocol ok %s", conn.Info())
+	return true
+}
@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// 把收到的PROXY protocol头原样发回去
+func startProxyProtocolOrigin(t *testing.T, addr string) net.Listener {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				sig, err := reader.Peek(len(proxyProtocolV2Sig))
+				if err != nil {
+					return
+				}
+				var header []byte
+				if bytes.Equal(sig, proxyProtocolV2Sig) {
+					header = make([]byte, 16)
+					if _, err := io.ReadFull(reader, header); err != nil {
+						return
+					}
+					addr := make([]byte, binary.BigEndian.Uint16(header[14:]))
+					if _, err := io.ReadFull(reader, addr); err != nil {
+						return
+					}
+					header = append(header, addr...)
+				} else {
+					header, err = reader.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+				}
+				conn.Write(header)
+				io.Copy(io.Discard, reader)
+			}()
+		}
+	}()
+	return l
+}
+
+func checkProxyProtocolOrigin(addr string, version string, timeout time.Duration) error {
+	expectlen := func(local string) int {
+		return len(makeProxyProtocolHeader(version, local, addr))
+	}
+	var err error
+	begin := time.Now()
+	for time.Since(begin) < timeout {
+		// 先连一次拿到本地地址的长度，v1的端口位数会变
+		var conn net.Conn
+		conn, err = net.Dial("tcp", addr)
+		if err != nil {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		local := conn.LocalAddr().String()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		header := make([]byte, expectlen(local))
+		_, err = io.ReadFull(conn, header)
+		conn.Close()
+		if err == nil {
+			expect := makeProxyProtocolHeader(version, local, addr)
+			if bytes.Equal(header, expect) {
+				return nil
+			}
+			err = echoError("proxy protocol header " + string(header))
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return err
+}
+
+func Test0014ProxyProtocol(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	if string(makeProxyProtocolHeader(PROXY_PROTOCOL_V1, "1.2.3.4:5", "[::1]:6")) != "PROXY TCP6 ::ffff:1.2.3.4 ::1 5 6\r\n" {
+		t.Fatal("v1 mixed family should be TCP6")
+	}
+	if string(makeProxyProtocolHeader(PROXY_PROTOCOL_V1, "", "")) != "PROXY UNKNOWN\r\n" {
+		t.Fatal("v1 unknown")
+	}
+	local := makeProxyProtocolHeader(PROXY_PROTOCOL_V2, "pipe", "pipe")
+	if len(local) != 16 || local[12] != 0x20 {
+		t.Fatal("v2 unknown should be LOCAL")
+	}
+	v2 := makeProxyProtocolHeader(PROXY_PROTOCOL_V2, "1.2.3.4:5", "5.6.7.8:6")
+	if len(v2) != 28 || v2[13] != 0x11 || binary.BigEndian.Uint16(v2[26:]) != 6 {
+		t.Fatal("v2 tcp4 error")
+	}
+	if checkProxyProtocol("v3") == nil {
+		t.Fatal("v3 should be error")
+	}
+
+	l := startProxyProtocolOrigin(t, "127.0.0.1:33110")
+	defer l.Close()
+
+	config := DefaultConfig()
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:33100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// reverse的Outputer在client上
+	rconfig := DefaultConfig()
+	rconfig.ProxyProtocol = PROXY_PROTOCOL_V1
+	rc, err := NewClient(rconfig, "tcp", "127.0.0.1:33100", "test_pp_reverse", "REVERSE_PROXY", []string{"tcp"}, []string{"127.0.0.1:33101"}, []string{"127.0.0.1:33110"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	if err := checkProxyProtocolOrigin("127.0.0.1:33101", PROXY_PROTOCOL_V1, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 正向的Outputer在server上，按client登录时的配置
+	pconfig := DefaultConfig()
+	pconfig.ProxyProtocol = PROXY_PROTOCOL_V2
+	pc, err := NewClient(pconfig, "tcp", "127.0.0.1:33100", "test_pp_proxy", "PROXY", []string{"tcp"}, []string{"127.0.0.1:33102"}, []string{"127.0.0.1:33110"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	if err := checkProxyProtocolOrigin("127.0.0.1:33102", PROXY_PROTOCOL_V2, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 模拟L4负载均衡，连后端时带上v2头
+func startProxyProtocolBalancer(t *testing.T, addr string, backend string, src string) net.Listener {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				bconn, err := net.Dial("tcp", backend)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				bconn.Write(makeProxyProtocolHeader(PROXY_PROTOCOL_V2, src, backend))
+				pipeConn(conn, bconn)
+			}()
+		}
+	}()
+	return l
+}
+
+func Test0015AcceptProxyProtocol(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	for _, version := range []string{PROXY_PROTOCOL_V1, PROXY_PROTOCOL_V2} {
+		for _, src := range []string{"10.1.2.3:4567", "[2001:db8::1]:80"} {
+			addr, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(makeProxyProtocolHeader(version, src, "127.0.0.1:80"))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != src {
+				t.Fatal("proxy protocol src error", version, src, addr)
+			}
+		}
+		addr, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(makeProxyProtocolHeader(version, "", ""))))
+		if err != nil || addr != nil {
+			t.Fatal("proxy protocol unknown error", version, addr, err)
+		}
+	}
+	if _, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n")))); err == nil {
+		t.Fatal("no header should be error")
+	}
+	if _, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n")))); err == nil {
+		t.Fatal("bad v1 header should be error")
+	}
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("bad trusted proxy should be error")
+	}
+	if _, err := NewServer(&Config{AcceptProxyProtocol: true}, []string{"tcp"}, []string{"127.0.0.1:33200"}); err == nil {
+		t.Fatal("accept proxy protocol need trusted proxies")
+	}
+	trusted := &Config{AcceptProxyProtocol: true, TrustedProxies: []string{"10.0.0.0/8", "::ffff:127.0.0.1"}}
+	if !isTrustedProxy(trusted, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 80}) ||
+		!isTrustedProxy(trusted, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80}) ||
+		isTrustedProxy(trusted, &net.TCPAddr{IP: net.ParseIP("11.1.2.3"), Port: 80}) {
+		t.Fatal("trusted proxy match error")
+	}
+
+	o := startProxyProtocolOrigin(t, "127.0.0.1:33210")
+	defer o.Close()
+
+	b := startProxyProtocolBalancer(t, "127.0.0.1:33201", "127.0.0.1:33200", "10.1.2.3:4567")
+	defer b.Close()
+
+	config := DefaultConfig()
+	config.AcceptProxyProtocol = true
+	config.TrustedProxies = []string{"127.0.0.1"}
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:33200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// client经过负载均衡连server，本地端口也接受PROXY protocol，再用v1告诉目标
+	cconfig := DefaultConfig()
+	cconfig.AcceptProxyProtocol = true
+	cconfig.TrustedProxies = []string{"127.0.0.0/8"}
+	cconfig.ProxyProtocol = PROXY_PROTOCOL_V1
+	c, err := NewClient(cconfig, "tcp", "127.0.0.1:33201", "test_accept_pp", "PROXY", []string{"tcp"}, []string{"127.0.0.1:33202"}, []string{"127.0.0.1:33210"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	expect := makeProxyProtocolHeader(PROXY_PROTOCOL_V1, "10.9.8.7:1111", "127.0.0.1:33202")
+	var lasterr error
+	begin := time.Now()
+	for time.Since(begin) < 10*time.Second {
+		lasterr = func() error {
+			conn, err := net.Dial("tcp", "127.0.0.1:33202")
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			conn.Write(makeProxyProtocolHeader(PROXY_PROTOCOL_V2, "10.9.8.7:1111", "127.0.0.1:33202"))
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			header := make([]byte, len(expect))
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return err
+			}
+			if !bytes.Equal(header, expect) {
+				return echoError("proxy protocol header " + string(header))
+			}
+			return nil
+		}()
+		if lasterr == nil {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if lasterr != nil {
+		t.Fatal(lasterr)
+	}
+
+	found := false
+	s.clients.Range(func(key, value interface{}) bool {
+		if strings.Contains(value.(*ClientConn).conn.Info(), "10.1.2.3:4567") {
+			found = true
+		}
+		return true
+	})
+	if !found {
+		t.Fatal("server should see the real client address")
+	}
+
+	// 没有头的连接直接断开
+	conn, err := net.Dial("tcp", "127.0.0.1:33202")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello spp no header\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("conn without header should be closed", err)
+	}
+
+	// 不在信任列表里的来源，带了头也断开
+	nconfig := *config
+	nconfig.TrustedProxies = []string{"10.0.0.0/8"}
+	if err := s.Reload(&nconfig, []string{"tcp"}, []string{"127.0.0.1:33200"}); err != nil {
+		t.Fatal(err)
+	}
+	uconn, err := net.Dial("tcp", "127.0.0.1:33200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	uconn.Write(makeProxyProtocolHeader(PROXY_PROTOCOL_V1, "10.9.8.7:1111", "127.0.0.1:33200"))
+	uconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// 没读的头还在缓冲区里，关闭时可能是RST
+	if _, err := uconn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Fatal("untrusted conn should be closed", err)
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// 同名的主通道共用一份配额，服务组成员和被接替的主通道也算在一起
+type clientQuota struct {
+	refs    int         // 用它的主通道数，quotaLock保护，减到0从quotas里删掉
+	streams int32       // 打开还没结束的连接，包括正在拨号的
+	open    tokenBucket // 每秒能打开的连接数
+}
+
+// client上的主通道没有配额，不用计数
+func (q *clientQuota) addStream(n int32) {
+	if q != nil {
+		atomic.AddInt32(&q.streams, n)
+	}
+}
+
+// 登录成功时拿到名字对应的配额，主通道结束时releaseQuota放掉
+func (s *Server) acquireQuota(name string) *clientQuota {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+	q, ok := s.quotas[name]
+	if !ok {
+		q = &clientQuota{}
+		q.open.set(int64(s.getConfig().OpenRateLimit), 0)
+		s.quotas[name] = q
+	}
+	q.refs++
+	return q
+}
+
+func (s *Server) releaseQuota(name string, q *clientQuota) {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+	q.refs--
+	if q.refs <= 0 && s.quotas[name] == q {
+		delete(s.quotas, name)
+	}
+}
+
+func (s *Server) reloadOpenLimits(config *Config) {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+	for _, q := range s.quotas {
+		q.open.set(int64(config.OpenRateLimit), 0)
+	}
+}
+
+// client发来的OPEN超过了哪个限制，没超过返回空，正在拨号的连接也算在里面
+func (s *Server) checkOpenQuota(clientconn *ClientConn) string {
+	config := s.getConfig()
+
+	if config.MaxClientStreams > 0 && int(atomic.LoadInt32(&clientconn.quota.streams)) >= config.MaxClientStreams {
+		return "max client streams " + strconv.Itoa(config.MaxClientStreams)
+	}
+
+	if !clientconn.quota.open.allow(1) {
+		return "open rate limit " + strconv.Itoa(config.OpenRateLimit) + "/s"
+	}
+	return ""
+}
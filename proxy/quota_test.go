@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func waitStreamSize(s *Server, size int, timeout time.Duration) int {
+	n := s.streamSize()
+	begin := time.Now()
+	for n != size && time.Since(begin) < timeout {
+		time.Sleep(200 * time.Millisecond)
+		n = s.streamSize()
+	}
+	return n
+}
+
+func quotaOf(s *Server, name string) *clientQuota {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+	return s.quotas[name]
+}
+
+func findAccessReason(filename string, reason string) bool {
+	records, _ := readAccessLog(filename)
+	for _, r := range records {
+		if r.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func Test0026Quota(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	echo := startEcho(t, "tcp", "127.0.0.1:34302")
+	defer echo.Close()
+
+	config := DefaultConfig()
+	config.MaxClientStreams = 2
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:34300"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 本地连接关掉以后等不活跃超时才结束，checkSonnyActive过了EstablishedTimeout才开始算
+	dir := t.TempDir()
+	cconfig := DefaultConfig()
+	cconfig.EstablishedTimeout = 2
+	cconfig.ConnTimeout = 2
+	cconfig.AccessLog = filepath.Join(dir, "client.log")
+	c, err := NewClient(cconfig, "tcp", "127.0.0.1:34300", "test_quota", "PROXY", []string{"tcp", "tcp"},
+		[]string{"127.0.0.1:34303", "127.0.0.1:34304"}, []string{"127.0.0.1:34302", "127.0.0.1:34305"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := checkEcho("tcp", "127.0.0.1:34303", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 连不上目标的连接马上结束，不占名额
+	for i := 0; i < 3; i++ {
+		if err := tryEcho("tcp", "127.0.0.1:34304"); err == nil {
+			t.Fatal("dead target should fail")
+		}
+	}
+	if n := waitStreamSize(s, 0, 10*time.Second); n != 0 {
+		t.Fatal("stream not end", n)
+	}
+
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:34303")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		if err := echoOnce(conn, []byte("hello spp quota")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 同时打开的连接数满了，OPENRSP说明是哪个限制
+	if err := tryEcho("tcp", "127.0.0.1:34303"); err == nil {
+		t.Fatal("max client streams not limited")
+	}
+	begin := time.Now()
+	for !findAccessReason(cconfig.AccessLog, "open fail max client streams 2") && time.Since(begin) < 10*time.Second {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if !findAccessReason(cconfig.AccessLog, "open fail max client streams 2") {
+		t.Fatal("no max client streams record")
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	conns = nil
+	if n := waitStreamSize(s, 0, 10*time.Second); n != 0 {
+		t.Fatal("stream not end", n)
+	}
+	if n := atomic.LoadInt32(&quotaOf(s, "test_quota_0").streams); n != 0 {
+		t.Fatal("open streams not released", n)
+	}
+
+	// 重新加载换成限制每秒打开的数目，令牌桶一开始是满的
+	nconfig := *config
+	nconfig.MaxClientStreams = 0
+	nconfig.OpenRateLimit = 2
+	if err := s.Reload(&nconfig, []string{"tcp"}, []string{"127.0.0.1:34300"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := tryEcho("tcp", "127.0.0.1:34303"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tryEcho("tcp", "127.0.0.1:34303"); err == nil {
+		t.Fatal("open rate not limited")
+	}
+	begin = time.Now()
+	for !findAccessReason(cconfig.AccessLog, "open fail open rate limit 2/s") && time.Since(begin) < 10*time.Second {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if !findAccessReason(cconfig.AccessLog, "open fail open rate limit 2/s") {
+		t.Fatal("no open rate limit record")
+	}
+
+	time.Sleep(time.Second)
+	if err := tryEcho("tcp", "127.0.0.1:34303"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 名字的最后一个主通道结束，配额也删掉
+	c.Close()
+	begin = time.Now()
+	for quotaOf(s, "test_quota_0") != nil && time.Since(begin) < 10*time.Second {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if quotaOf(s, "test_quota_0") != nil {
+		t.Fatal("quota not released")
+	}
+}
@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/thread"
+)
+
+// 限速设置，单位KB，0表示不限
+type RateLimit struct {
+	Rate   int `json:"rate"`   // 每秒多少KB，两个方向分开算
+	Burst  int `json:"burst"`  // 空闲以后一下子可以用掉多少KB，0和Rate一样
+	Stream int `json:"stream"` // 每个连接每秒多少KB
+}
+
+func configRateLimit(config *Config) RateLimit {
+	return RateLimit{Rate: config.RateLimit, Burst: config.RateBurst, Stream: config.StreamRateLimit}
+}
+
+// 令牌桶，rate是每秒的字节数，rate<=0不限速
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// 调用时要拿着lock
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) set(rate int64, burst int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(time.Now())
+	if burst <= 0 {
+		burst = rate
+	}
+	if b.rate <= 0 {
+		// 原来不限速，从满的桶开始
+		b.tokens = float64(burst)
+	}
+	b.rate = float64(rate)
+	b.burst = float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// 取n个字节的令牌，不够时先欠着，返回要等多久，后面的调用等得更久
+func (b *tokenBucket) take(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// 令牌够n个才取，不欠，不够返回false
+func (b *tokenBucket) allow(n int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// 还欠着的令牌要等多久才能还清
+func (b *tokenBucket) delay() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// 一个client名字或者一个隧道的限速，所有连接共用
+type rateLimiter struct {
+	recv  tokenBucket // 从本地连接读到的
+	send  tokenBucket // 写给本地连接的
+	limit atomic.Pointer[RateLimit]
+}
+
+func newRateLimiter(r RateLimit) *rateLimiter {
+	l := &rateLimiter{}
+	l.set(r)
+	return l
+}
+
+func (l *rateLimiter) set(r RateLimit) {
+	l.limit.Store(&r)
+	l.recv.set(int64(r.Rate)*1024, int64(r.Burst)*1024)
+	l.send.set(int64(r.Rate)*1024, int64(r.Burst)*1024)
+}
+
+func (l *rateLimiter) get() RateLimit {
+	return *l.limit.Load()
+}
+
+// 连接自己的限速按第一次用到时主通道上的设置建，之后改设置只影响新的连接
+func (p *ProxyConn) streamRateLimiter(father *ProxyConn) *rateLimiter {
+	if l := p.ratelimit.Load(); l != nil {
+		return l
+	}
+	if father == nil {
+		return nil
+	}
+	fl := father.ratelimit.Load()
+	if fl == nil || fl.get().Stream <= 0 {
+		return nil
+	}
+	p.ratelimit.CompareAndSwap(nil, newRateLimiter(RateLimit{Rate: fl.get().Stream}))
+	return p.ratelimit.Load()
+}
+
+// 按主通道和连接自己的限速等够时间，退出时不再等
+func throttle(wg *thread.Group, sonny *ProxyConn, father *ProxyConn, size int, send bool) {
+	if father == nil {
+		return
+	}
+
+	var wait time.Duration
+	for _, l := range []*rateLimiter{father.ratelimit.Load(), sonny.streamRateLimiter(father)} {
+		if l == nil {
+			continue
+		}
+		b := &l.recv
+		if send {
+			b = &l.send
+		}
+		if d := b.take(size); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return
+	}
+
+	atomic.AddInt64(&father.throttled, int64(wait))
+	father.getMetrics().throttle(wait)
+	if loggo.IsDebug() {
+		loggo.Debug("throttle %s %d %s", sonny.id, size, wait)
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-wg.Done():
+	case <-timer.C:
+	}
+}
+
+// 限速时sendToSonny要等，连接的发送缓冲放大这么多倍，主通道转发还是原来的超时，不会被一个连接卡住
+const rateLimitConnBufferScale = 8
+
+func sonnyConnBuffer(config *Config, father *ProxyConn) int {
+	if father == nil {
+		return config.ConnBuffer
+	}
+	l := father.ratelimit.Load()
+	if l == nil {
+		return config.ConnBuffer
+	}
+	if r := l.get(); r.Rate <= 0 && r.Stream <= 0 {
+		return config.ConnBuffer
+	}
+	return config.ConnBuffer * rateLimitConnBufferScale
+}
+
+// server上按client名字共用一个限速，配置里单独设置过的名字用自己的
+func serverRateLimit(config *Config, name string) RateLimit {
+	r := configRateLimit(config)
+	if rate, ok := config.ClientRateLimits[name]; ok {
+		r.Rate = rate
+	}
+	return r
+}
+
+// server上一个名字的限速，没有主通道用、也没单独设置过就删掉
+type clientRateLimit struct {
+	limiter *rateLimiter
+	refs    int  // 用它的主通道数
+	pinned  bool // SetRateLimit设置过，重新加载配置以前一直留着
+}
+
+func (s *Server) loadRateLimit(name string) *clientRateLimit {
+	l, ok := s.ratelimits[name]
+	if !ok {
+		l = &clientRateLimit{limiter: newRateLimiter(serverRateLimit(s.getConfig(), name))}
+		s.ratelimits[name] = l
+	}
+	return l
+}
+
+func (s *Server) pruneRateLimit(config *Config, name string, l *clientRateLimit) {
+	if l.refs > 0 || l.pinned {
+		return
+	}
+	if _, ok := config.ClientRateLimits[name]; ok {
+		return
+	}
+	delete(s.ratelimits, name)
+}
+
+// 登录成功时拿到名字对应的限速，主通道结束时releaseRateLimiter放掉
+func (s *Server) acquireRateLimiter(name string) *rateLimiter {
+	s.ratelimitLock.Lock()
+	defer s.ratelimitLock.Unlock()
+	l := s.loadRateLimit(name)
+	l.refs++
+	return l.limiter
+}
+
+func (s *Server) releaseRateLimiter(name string) {
+	s.ratelimitLock.Lock()
+	defer s.ratelimitLock.Unlock()
+	if l, ok := s.ratelimits[name]; ok {
+		l.refs--
+		s.pruneRateLimit(s.getConfig(), name, l)
+	}
+}
+
+// 名字现在的限速，还没有的按配置算
+func (s *Server) getRateLimit(name string) RateLimit {
+	s.ratelimitLock.Lock()
+	defer s.ratelimitLock.Unlock()
+	if l, ok := s.ratelimits[name]; ok {
+		return l.limiter.get()
+	}
+	return serverRateLimit(s.getConfig(), name)
+}
+
+// 马上对这个名字的所有连接生效，重新加载配置时按配置文件改回来
+func (s *Server) SetRateLimit(name string, r RateLimit) {
+	s.ratelimitLock.Lock()
+	l := s.loadRateLimit(name)
+	l.pinned = true
+	l.limiter.set(r)
+	s.ratelimitLock.Unlock()
+	loggo.Info("Server SetRateLimit %s %d %d %d", name, r.Rate, r.Burst, r.Stream)
+}
+
+func (s *Server) RateLimits() map[string]RateLimit {
+	s.ratelimitLock.Lock()
+	defer s.ratelimitLock.Unlock()
+	ret := make(map[string]RateLimit)
+	for name, l := range s.ratelimits {
+		ret[name] = l.limiter.get()
+	}
+	return ret
+}
+
+func (s *Server) reloadRateLimits(config *Config) {
+	s.ratelimitLock.Lock()
+	defer s.ratelimitLock.Unlock()
+	for name, l := range s.ratelimits {
+		l.limiter.set(serverRateLimit(config, name))
+		l.pinned = false
+		s.pruneRateLimit(config, name, l)
+	}
+}
+
+// client上每个隧道一个限速，马上生效
+func (c *Client) SetRateLimit(r RateLimit) {
+	for _, l := range c.ratelimits {
+		l.set(r)
+	}
+	loggo.Info("Client SetRateLimit %s %d %d %d", c.name, r.Rate, r.Burst, r.Stream)
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// 把src写过去再全部读回来，返回花的时间
+func echoBulk(addr string, src []byte) (time.Duration, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	begin := time.Now()
+	go conn.Write(src)
+
+	conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	dst := make([]byte, len(src))
+	if _, err := io.ReadFull(conn, dst); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(src, dst) {
+		return 0, errEchoMismatch
+	}
+	return time.Since(begin), nil
+}
+
+func Test0024RateLimit(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	var b tokenBucket
+	if d := b.take(1024 * 1024); d != 0 {
+		t.Fatal("no limit should not wait", d)
+	}
+	b.set(1000, 0)
+	if d := b.take(1000); d != 0 {
+		t.Fatal("burst should not wait", d)
+	}
+	if d := b.take(500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatal("take wait error", d)
+	}
+	if d := b.delay(); d <= 0 || d > 500*time.Millisecond {
+		t.Fatal("delay error", d)
+	}
+	b.set(0, 0)
+	if d := b.take(1000); d != 0 || b.delay() != 0 {
+		t.Fatal("remove limit should not wait", d)
+	}
+
+	echo := startEcho(t, "tcp", "127.0.0.1:34002")
+	defer echo.Close()
+
+	config := DefaultConfig()
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:34000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := NewClient(DefaultConfig(), "tcp", "127.0.0.1:34000", "test_ratelimit", "PROXY", []string{"tcp"}, []string{"127.0.0.1:34003"}, []string{"127.0.0.1:34002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := checkEcho("tcp", "127.0.0.1:34003", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	size := 256 * 1024
+	data := bytes.Repeat([]byte("spp ratelimit "), size/14+1)[:size]
+	if d, err := echoBulk("127.0.0.1:34003", data); err != nil || d > time.Second {
+		t.Fatal("no limit", d, err)
+	}
+
+	// 重新加载配置按名字限速，已经连上的client马上生效
+	nconfig := *config
+	nconfig.ClientRateLimits = map[string]int{"test_ratelimit_0": 128}
+	if err := s.Reload(&nconfig, []string{"tcp"}, []string{"127.0.0.1:34000"}); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.RateLimits()["test_ratelimit_0"]; r.Rate != 128 {
+		t.Fatal("reload rate limit error", r)
+	}
+	if d, err := echoBulk("127.0.0.1:34003", data); err != nil || d < time.Second {
+		t.Fatal("server limit", d, err)
+	}
+	stats := s.Stats()
+	if len(stats) != 1 || stats[0].ThrottledMs <= 0 {
+		t.Fatal("server throttled stats error", stats)
+	}
+
+	s.SetRateLimit("test_ratelimit_0", RateLimit{})
+	if d, err := echoBulk("127.0.0.1:34003", data); err != nil || d > time.Second {
+		t.Fatal("server limit removed", d, err)
+	}
+
+	// client每个隧道的限速和每个连接的限速
+	c.SetRateLimit(RateLimit{Stream: 128})
+	if d, err := echoBulk("127.0.0.1:34003", data); err != nil || d < time.Second {
+		t.Fatal("client stream limit", d, err)
+	}
+	c.SetRateLimit(RateLimit{})
+	if d, err := echoBulk("127.0.0.1:34003", data); err != nil || d > time.Second {
+		t.Fatal("client limit removed", d, err)
+	}
+	if stats := c.Stats(); len(stats) != 1 || stats[0].ThrottledMs <= 0 {
+		t.Fatal("client throttled stats error", stats)
+	}
+
+	// 单独设置过或者配置里有的名字没有连接也留着，重新加载以后连接都结束了就删掉
+	s.SetRateLimit("test_ratelimit_9", RateLimit{Rate: 128})
+	if r := s.RateLimits(); len(r) != 2 || r["test_ratelimit_9"].Rate != 128 {
+		t.Fatal("set rate limit error", r)
+	}
+	c.Close()
+	if err := s.Reload(config, []string{"tcp"}, []string{"127.0.0.1:34000"}); err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Now()
+	for len(s.RateLimits()) != 0 && time.Since(begin) < 10*time.Second {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if r := s.RateLimits(); len(r) != 0 {
+		t.Fatal("rate limit not released", r)
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// 连接不落在server上，在两个client的主通道之间直接转发
+type clientRelay struct {
+	id       string
+	visitor  *ClientConn
+	provider *ClientConn
+	begin    time.Time
+	upsize   int64 // visitor发给provider的字节
+	downsize int64 // provider发给visitor的字节
+}
+
+// 把visitor的OPEN转给provider，OPENRSP失败由调用者回给visitor
+func (s *Server) openRelay(f *ProxyFrame, visitor *ClientConn, provider *ClientConn) bool {
+	id := f.OpenFrame.Id
+	relay := &clientRelay{id: id, visitor: visitor, provider: provider, begin: time.Now()}
+	_, loaded := s.relays.LoadOrStore(id, relay)
+	if loaded {
+		return false
+	}
+	visitor.quota.addStream(1)
+	if !provider.sendch.WriteTimeout(f, s.getConfig().MainWriteChannelTimeoutMs) {
+		s.deleteRelay(id)
+		return false
+	}
+	return true
+}
+
+// 转发结束，visitor打开的连接数减掉，同一个id只减一次
+func (s *Server) deleteRelay(id string) {
+	if v, ok := s.relays.LoadAndDelete(id); ok {
+		v.(*clientRelay).visitor.quota.addStream(-1)
+	}
+}
+
+// 在visitor和provider之间转发OPENRSP DATA CLOSE，不是转发的连接返回false
+func (s *Server) relayFrame(id string, f *ProxyFrame, from *ClientConn) bool {
+	v, ok := s.relays.Load(id)
+	if !ok {
+		return false
+	}
+	relay := v.(*clientRelay)
+
+	var to *ClientConn
+	var size *int64
+	if from == relay.provider {
+		to = relay.visitor
+		size = &relay.downsize
+	} else if from == relay.visitor {
+		to = relay.provider
+		size = &relay.upsize
+	} else {
+		loggo.Error("relayFrame not in relay %s %s", id, from.conn.Info())
+		return false
+	}
+
+	if f.Type == FRAME_TYPE_DATA {
+		atomic.AddInt64(size, int64(len(f.DataFrame.Data)))
+	}
+
+	if f.Type == FRAME_TYPE_CLOSE || (f.Type == FRAME_TYPE_OPENRSP && !f.OpenRspFrame.Ret) {
+		s.deleteRelay(id)
+	}
+
+	if !to.sendch.WriteTimeout(f, s.getConfig().MainWriteChannelTimeoutMs) {
+		loggo.Error("relayFrame timeout %s %s -> %s", id, from.conn.Info(), to.conn.Info())
+		s.deleteRelay(id)
+		closeRemoteConn(&ProxyConn{id: id}, &relay.visitor.ProxyConn)
+		closeRemoteConn(&ProxyConn{id: id}, &relay.provider.ProxyConn)
+	}
+	return true
+}
+
+// 主通道断了，经过它的转发都通知另一端关闭
+func (s *Server) closeRelay(clientConn *ClientConn) {
+	s.relays.Range(func(key, value interface{}) bool {
+		relay := value.(*clientRelay)
+		if relay.visitor == clientConn {
+			closeRemoteConn(&ProxyConn{id: relay.id}, &relay.provider.ProxyConn)
+			s.deleteRelay(relay.id)
+		} else if relay.provider == clientConn {
+			closeRemoteConn(&ProxyConn{id: relay.id}, &relay.visitor.ProxyConn)
+			s.deleteRelay(relay.id)
+		}
+		return true
+	})
+}
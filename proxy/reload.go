@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/network"
+)
+
+type serverListener struct {
+	key    string
+	proto  string
+	addr   string
+	conn   network.Conn
+	closed int32
+}
+
+// 同样的proto和addr认为是同一个监听，tcp接受PROXY protocol时监听的实现不一样，也要区分开
+func serverListenerKey(config *Config, proto string, addr string) string {
+	proto = strings.ToLower(proto)
+	key := proto + " " + addr
+	if config.AcceptProxyProtocol && proto == "tcp" {
+		key += " proxy-protocol"
+	}
+	return key
+}
+
+func newServerListener(config *Config, proto string, addr string) (*serverListener, error) {
+	conn, err := network.NewConn(proto)
+	if conn == nil {
+		return nil, err
+	}
+
+	setCongestion(conn, config)
+
+	var listenConn network.Conn
+	if config.AcceptProxyProtocol && strings.ToLower(proto) == "tcp" {
+		listenConn, err = listenTcp(addr)
+	} else {
+		listenConn, err = conn.Listen(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &serverListener{
+		key:   serverListenerKey(config, proto, addr),
+		proto: proto,
+		addr:  addr,
+		conn:  listenConn,
+	}, nil
+}
+
+func (l *serverListener) close() {
+	atomic.StoreInt32(&l.closed, 1)
+	l.conn.Close()
+}
+
+// 重新加载server的配置，增删监听端口，新连上的client用新配置，已经连上的client和它们的连接不受影响
+func (s *Server) Reload(config *Config, proto []string, listenaddrs []string) error {
+	if len(proto) != len(listenaddrs) {
+		return errors.New("proto listen len not equal")
+	}
+
+	if err := checkTrustedProxies(config); err != nil {
+		return err
+	}
+
+	old := s.getConfig()
+	if config.VhostHttp != old.VhostHttp || config.VhostHttps != old.VhostHttps || config.Admin != old.Admin || config.StatsFile != old.StatsFile ||
+		config.AccessLog != old.AccessLog {
+		loggo.Error("Server Reload vhost admin stats-file access-log change need restart %s %s %s %s %s", config.VhostHttp, config.VhostHttps, config.Admin, config.StatsFile, config.AccessLog)
+		c := *config
+		c.VhostHttp = old.VhostHttp
+		c.VhostHttps = old.VhostHttps
+		c.Admin = old.Admin
+		c.StatsFile = old.StatsFile
+		c.AccessLog = old.AccessLog
+		config = &c
+	}
+	reloadAccessLog(config)
+
+	s.listenLock.Lock()
+	defer s.listenLock.Unlock()
+
+	want := make(map[string]int)
+	for i, _ := range proto {
+		want[serverListenerKey(config, proto[i], listenaddrs[i])] = i
+	}
+
+	for key, l := range s.listeners {
+		if _, ok := want[key]; !ok {
+			loggo.Info("Server Reload close listen %s %s", l.proto, l.addr)
+			l.close()
+			delete(s.listeners, key)
+		}
+	}
+
+	var err error
+	for key, i := range want {
+		if _, ok := s.listeners[key]; ok {
+			continue
+		}
+		l, e := newServerListener(config, proto[i], listenaddrs[i])
+		if e != nil {
+			loggo.Error("Server Reload listen fail %s %s %s", proto[i], listenaddrs[i], e)
+			err = e
+			continue
+		}
+		loggo.Info("Server Reload new listen %s %s", l.proto, l.addr)
+		s.startListen(l)
+	}
+
+	s.config.Store(config)
+	s.reloadRateLimits(config)
+	s.reloadOpenLimits(config)
+	s.fair.reload(config)
+
+	loggo.Info("Server Reload ok %d", len(s.listeners))
+	return err
+}
+
+// 按配置文件跑起来的server或client，重新加载时只动有变化的部分
+type FileRunner struct {
+	filename string
+	lock     sync.Mutex
+	fc       *FileConfig
+	server   *Server
+	clients  map[string]*fileRunnerClient
+}
+
+type fileRunnerClient struct {
+	tunnel *FileTunnel
+	client *Client
+}
+
+func fileListen(fc *FileConfig) ([]string, []string) {
+	var protos []string
+	var listenaddrs []string
+	for _, l := range fc.Listen {
+		protos = append(protos, l.Proto)
+		listenaddrs = append(listenaddrs, l.Addr)
+	}
+	return protos, listenaddrs
+}
+
+func startFileTunnel(tunnel *FileTunnel) (*Client, error) {
+	var toaddr []string
+	if len(tunnel.Toaddr) > 0 {
+		toaddr = append(toaddr, tunnel.Toaddr)
+	}
+	return NewMultiClient(tunnel.Config, tunnel.Servers, tunnel.Name, tunnel.Clienttype, []string{tunnel.Proxyproto}, []string{tunnel.Fromaddr}, toaddr)
+}
+
+// 行号、限速和access log的轮转配置变了不算隧道变了，直接改
+func sameFileTunnel(a *FileTunnel, b *FileTunnel) bool {
+	x := *a
+	y := *b
+	x.Line = 0
+	y.Line = 0
+	if x.Config != nil && y.Config != nil {
+		xc := *x.Config
+		yc := *y.Config
+		xc.RateLimit, xc.RateBurst, xc.StreamRateLimit = 0, 0, 0
+		yc.RateLimit, yc.RateBurst, yc.StreamRateLimit = 0, 0, 0
+		xc.AccessLogMaxSize, xc.AccessLogMaxBackups = 0, 0
+		yc.AccessLogMaxSize, yc.AccessLogMaxBackups = 0, 0
+		x.Config = &xc
+		y.Config = &yc
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func StartFileRunner(filename string, fc *FileConfig) (*FileRunner, error) {
+	r := &FileRunner{
+		filename: filename,
+		fc:       fc,
+		clients:  make(map[string]*fileRunnerClient),
+	}
+
+	if fc.Type == "server" {
+		protos, listenaddrs := fileListen(fc)
+		server, err := NewServer(fc.Config, protos, listenaddrs)
+		if err != nil {
+			return nil, err
+		}
+		r.server = server
+		return r, nil
+	}
+
+	for _, tunnel := range fc.Tunnels {
+		client, err := startFileTunnel(tunnel)
+		if err != nil {
+			r.Close()
+			return nil, &fileError{filename, tunnel.Line, "tunnel " + tunnel.Name + " " + err.Error()}
+		}
+		r.clients[tunnel.Name] = &fileRunnerClient{tunnel: tunnel, client: client}
+		loggo.Info("FileRunner start tunnel %s", tunnel.Name)
+	}
+	return r, nil
+}
+
+func (r *FileRunner) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.server != nil {
+		r.server.Close()
+	}
+	for _, rc := range r.clients {
+		rc.client.Close()
+	}
+}
+
+// 所有隧道一起优雅关闭，总共最多等ShutdownTimeout秒
+func (r *FileRunner) Shutdown() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.server != nil {
+		r.server.Shutdown()
+	}
+
+	var wg sync.WaitGroup
+	for _, rc := range r.clients {
+		client := rc.client
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Shutdown()
+		}()
+	}
+	wg.Wait()
+}
+
+// 重新读配置文件，server增删监听换配置；client新加的隧道启动，删掉的和改过的隧道关掉重建，没变的隧道和上面的连接不动
+func (r *FileRunner) Reload() error {
+	fc, err := LoadConfigFile(r.filename)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if fc.Type != r.fc.Type {
+		return errors.New(r.filename + ": type change need restart")
+	}
+
+	if r.server != nil {
+		protos, listenaddrs := fileListen(fc)
+		err = r.server.Reload(fc.Config, protos, listenaddrs)
+		r.fc = fc
+		return err
+	}
+
+	tunnels := make(map[string]*FileTunnel)
+	for _, tunnel := range fc.Tunnels {
+		tunnels[tunnel.Name] = tunnel
+	}
+
+	for name, rc := range r.clients {
+		tunnel, ok := tunnels[name]
+		if ok && sameFileTunnel(rc.tunnel, tunnel) {
+			if configRateLimit(rc.tunnel.Config) != configRateLimit(tunnel.Config) {
+				rc.client.SetRateLimit(configRateLimit(tunnel.Config))
+			}
+			rc.tunnel = tunnel
+			continue
+		}
+		loggo.Info("FileRunner close tunnel %s", name)
+		rc.client.Close()
+		delete(r.clients, name)
+	}
+
+	for _, tunnel := range fc.Tunnels {
+		if _, ok := r.clients[tunnel.Name]; ok {
+			continue
+		}
+		client, e := startFileTunnel(tunnel)
+		if e != nil {
+			loggo.Error("FileRunner start tunnel fail %s %s", tunnel.Name, e)
+			err = &fileError{r.filename, tunnel.Line, "tunnel " + tunnel.Name + " " + e.Error()}
+			continue
+		}
+		r.clients[tunnel.Name] = &fileRunnerClient{tunnel: tunnel, client: client}
+		loggo.Info("FileRunner start tunnel %s", tunnel.Name)
+	}
+
+	for _, tunnel := range fc.Tunnels {
+		reloadAccessLog(tunnel.Config)
+	}
+
+	r.fc = fc
+	loggo.Info("FileRunner Reload ok %s %d", r.filename, len(r.clients))
+	return err
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func echoOnce(conn net.Conn, src []byte) error {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(src); err != nil {
+		return err
+	}
+	dst := make([]byte, len(src))
+	if _, err := io.ReadFull(conn, dst); err != nil {
+		return err
+	}
+	if !bytes.Equal(src, dst) {
+		return errEchoMismatch
+	}
+	return nil
+}
+
+func Test0017Reload(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	echo := startEcho(t, "tcp", "127.0.0.1:33310")
+	defer echo.Close()
+
+	config := DefaultConfig()
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:33300"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// server加一个监听
+	err = s.Reload(config, []string{"tcp", "tcp"}, []string{"127.0.0.1:33300", "127.0.0.1:33301"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "client.yml")
+	write := func(data string) {
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`
+type: client
+servers:
+  - addr: 127.0.0.1:33301
+tunnels:
+  - name: keep
+    type: proxy_client
+    fromaddr: 127.0.0.1:33302
+    toaddr: 127.0.0.1:33310
+  - name: remove
+    type: proxy_client
+    fromaddr: 127.0.0.1:33303
+    toaddr: 127.0.0.1:33310
+`)
+	fc, err := LoadConfigFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := StartFileRunner(filename, fc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := checkEcho("tcp", "127.0.0.1:33302", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEcho("tcp", "127.0.0.1:33303", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没变的隧道上的连接重新加载后还能用
+	conn, err := net.Dial("tcp", "127.0.0.1:33302")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := echoOnce(conn, []byte("before reload")); err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Reload(config, []string{"tcp"}, []string{"127.0.0.1:33301"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.DialTimeout("tcp", "127.0.0.1:33300", time.Second); err == nil {
+		t.Fatal("server listen should be closed")
+	}
+
+	write(`
+type: client
+servers:
+  - addr: 127.0.0.1:33301
+tunnels:
+  - name: add
+    type: proxy_client
+    fromaddr: 127.0.0.1:33304
+    toaddr: 127.0.0.1:33310
+  - name: keep
+    type: proxy_client
+    fromaddr: 127.0.0.1:33302
+    toaddr: 127.0.0.1:33310
+`)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := echoOnce(conn, []byte("after reload")); err != nil {
+		t.Fatal("keep tunnel conn", err)
+	}
+	if err := checkEcho("tcp", "127.0.0.1:33304", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	var lasterr error
+	begin := time.Now()
+	for time.Since(begin) < 5*time.Second {
+		c, err := net.DialTimeout("tcp", "127.0.0.1:33303", time.Second)
+		if err != nil {
+			lasterr = nil
+			break
+		}
+		c.Close()
+		lasterr = echoError("removed tunnel still listen")
+		time.Sleep(200 * time.Millisecond)
+	}
+	if lasterr != nil {
+		t.Fatal(lasterr)
+	}
+
+	// type变了要重启
+	write("type: server\nlisten:\n  - addr: 127.0.0.1:33305\n")
+	if err := r.Reload(); err == nil {
+		t.Fatal("type change should fail")
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// secret client把服务注册在server上但不监听，visitor的连接在server内部转发到secret client的主通道
+func isSecretType(clienttype CLIENT_TYPE) bool {
+	return clienttype == CLIENT_TYPE_SECRET || clienttype == CLIENT_TYPE_SECRET_VISITOR
+}
+
+func (s *Server) iniSecret(clientConn *ClientConn) error {
+	if len(clientConn.fromaddr) <= 0 {
+		return errors.New("secret service no name")
+	}
+	if len(clientConn.secret) <= 0 {
+		return errors.New("secret service no secret")
+	}
+	_, loaded := s.secrets.LoadOrStore(clientConn.fromaddr, clientConn)
+	if loaded {
+		return errors.New("secret service " + clientConn.fromaddr + " has registered")
+	}
+	loggo.Info("iniSecret ok %s %s", clientConn.fromaddr, clientConn.conn.Info())
+	return nil
+}
+
+func (s *Server) openSecret(f *ProxyFrame, visitor *ClientConn) {
+	id := f.OpenFrame.Id
+	name := f.OpenFrame.Toaddr
+
+	rf := &ProxyFrame{}
+	rf.Type = FRAME_TYPE_OPENRSP
+	rf.OpenRspFrame = &OpenConnRspFrame{}
+	rf.OpenRspFrame.Id = id
+
+	if !visitor.established.Load() {
+		rf.OpenRspFrame.Ret = false
+		rf.OpenRspFrame.Msg = "not login"
+		visitor.sendch.Write(rf)
+		loggo.Error("openSecret not login %s %s", id, visitor.conn.Info())
+		return
+	}
+
+	v, ok := s.secrets.Load(name)
+	if !ok {
+		rf.OpenRspFrame.Ret = false
+		rf.OpenRspFrame.Msg = "no secret service " + name
+		visitor.sendch.Write(rf)
+		loggo.Error("openSecret no secret service %s %s %s", id, name, visitor.conn.Info())
+		return
+	}
+	provider := v.(*ClientConn)
+
+	if subtle.ConstantTimeCompare([]byte(provider.secret), []byte(visitor.secret)) != 1 {
+		rf.OpenRspFrame.Ret = false
+		rf.OpenRspFrame.Msg = "secret error"
+		visitor.sendch.Write(rf)
+		loggo.Error("openSecret secret error %s %s %s", id, name, visitor.conn.Info())
+		return
+	}
+
+	// 目标地址由secret client自己决定，visitor只能访问注册的服务
+	f.OpenFrame.Toaddr = provider.toaddr
+	if !s.openRelay(f, visitor, provider) {
+		rf.OpenRspFrame.Ret = false
+		rf.OpenRspFrame.Msg = "relay fail"
+		visitor.sendch.Write(rf)
+		loggo.Error("openSecret relay fail %s %s %s", id, name, visitor.conn.Info())
+		return
+	}
+
+	loggo.Info("openSecret %s %s %s -> %s", id, name, visitor.conn.Info(), provider.conn.Info())
+}
+
+// secret client下线，服务名可以重新注册
+func (s *Server) closeSecret(clientConn *ClientConn) {
+	if clientConn.clienttype == CLIENT_TYPE_SECRET {
+		s.secrets.CompareAndDelete(clientConn.fromaddr, clientConn)
+	}
+}
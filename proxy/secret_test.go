@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func Test0012Secret(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	l := startEcho(t, "tcp", "127.0.0.1:32910")
+	defer l.Close()
+
+	config := DefaultConfig()
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:32900"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := NewClient(DefaultConfig(), "tcp", "127.0.0.1:32900", "test_secret_none", "SECRET", []string{"tcp"}, []string{"test_echo"}, []string{"127.0.0.1:32910"}); err == nil {
+		t.Fatal("secret client without secret should fail")
+	}
+
+	cconfig := DefaultConfig()
+	cconfig.Secret = "test_secret"
+
+	sc, err := NewClient(cconfig, "tcp", "127.0.0.1:32900", "test_secret", "SECRET", []string{"tcp"}, []string{"test_echo"}, []string{"127.0.0.1:32910"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	vc, err := NewClient(cconfig, "tcp", "127.0.0.1:32900", "test_secret_visitor", "SECRET_VISITOR", []string{"tcp"}, []string{"127.0.0.1:32901"}, []string{"test_echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vc.Close()
+
+	if err := checkEcho("tcp", "127.0.0.1:32901", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 密钥不对的visitor连不上
+	wconfig := DefaultConfig()
+	wconfig.Secret = "wrong_secret"
+	wc, err := NewClient(wconfig, "tcp", "127.0.0.1:32900", "test_secret_wrong", "SECRET_VISITOR", []string{"tcp"}, []string{"127.0.0.1:32902"}, []string{"test_echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wc.Close()
+
+	time.Sleep(time.Second)
+	if err := tryEcho("tcp", "127.0.0.1:32902"); err == nil {
+		t.Fatal("visitor with wrong secret should fail")
+	}
+
+	// secret client下线之后visitor也连不上
+	sc.Close()
+	begin := time.Now()
+	for time.Since(begin) < 10*time.Second {
+		if err := tryEcho("tcp", "127.0.0.1:32901"); err != nil {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Fatal("visitor should fail after secret client offline")
+}
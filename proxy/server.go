@@ -2,12 +2,15 @@ package proxy
 
 import (
 	"errors"
+	"net"
+	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/loggo"
-	"github.com/esrrhs/gohome/network"
 	"github.com/esrrhs/gohome/thread"
 )
 
@@ -22,14 +25,50 @@ type ClientConn struct {
 
 	input  *Inputer
 	output *Outputer
+	vhost  *vhostRoute
+	group  *serviceGroup
+	key    string  // clients里的key，服务组成员可以同名
+	config *Config // 连上时的server配置，重新加载不影响已有的client
+	secret string
+	exit   string
+	goaway int32 // 发过GOAWAY，client会连一条新的主通道来接替
+
+	allowexit  bool   // 登录时声明允许socks5 client从这里出去
+	exitsecret string // 出口client和socks5 client共用的密钥
 }
 
 type Server struct {
-	config      *Config
-	listenaddrs []string
-	listenConns []network.Conn
-	wg          *thread.Group
-	clients     sync.Map
+	config     atomic.Pointer[Config] // 重新加载时整个换掉，已经登录的client还用旧的
+	listeners  map[string]*serverListener
+	listenLock sync.Mutex
+	wg         *thread.Group
+	clients    sync.Map
+
+	httpRouter     *vhostRouter
+	httpsRouter    *vhostRouter
+	vhostListeners []net.Listener
+	vhostServer    *http.Server
+	adminServer    *http.Server
+
+	groups    map[string]*serviceGroup
+	groupLock sync.Mutex
+
+	secrets sync.Map // 服务名 -> secret client
+	relays  sync.Map // 连接id -> *clientRelay
+
+	traffic *trafficTotals
+	retired sync.Map // 被新主通道接替、还在等连接结束的client
+
+	ratelimits    map[string]*clientRateLimit // client名字 -> 限速
+	ratelimitLock sync.Mutex
+	fair          *fairScheduler
+
+	quotas    map[string]*clientQuota // client名字 -> 连接配额，没有主通道用了就删掉
+	quotaLock sync.Mutex
+
+	draining int32 // Shutdown开始以后不再接受新的client和连接
+
+	accesslog atomic.Pointer[accessLog] // Close时放掉引用，Shutdown以后再Close也只放一次
 }
 
 func NewServer(config *Config, proto []string, listenaddrs []string) (*Server, error) {
@@ -38,69 +77,137 @@ func NewServer(config *Config, proto []string, listenaddrs []string) (*Server, e
 		config = DefaultConfig()
 	}
 
-	var listenConns []network.Conn
+	err := checkTrustedProxies(config)
+	if err != nil {
+		return nil, err
+	}
 
-	for i, _ := range proto {
-		conn, err := network.NewConn(proto[i])
-		if conn == nil {
-			return nil, err
-		}
+	traffic, err := getTrafficTotals(config.StatsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	accesslog, err := openAccessLog(config)
+	if err != nil {
+		return nil, err
+	}
 
-		setCongestion(conn, config)
+	var listeners []*serverListener
 
-		listenConn, err := conn.Listen(listenaddrs[i])
+	for i, _ := range proto {
+		listener, err := newServerListener(config, proto[i], listenaddrs[i])
 		if err != nil {
+			for _, l := range listeners {
+				l.close()
+			}
+			closeAccessLog(accesslog)
 			return nil, err
 		}
 
-		listenConns = append(listenConns, listenConn)
+		listeners = append(listeners, listener)
 	}
 
+	var s *Server
 	wg := thread.NewGroup("Server", nil, func() {
-		for i, _ := range listenConns {
-			loggo.Info("group start exit %s", listenConns[i].Info())
-			listenConns[i].Close()
-			loggo.Info("group start exit %s", listenConns[i].Info())
+		s.listenLock.Lock()
+		for _, l := range s.listeners {
+			loggo.Info("group start exit %s", l.conn.Info())
+			l.close()
+			loggo.Info("group start exit %s", l.conn.Info())
+		}
+		s.listenLock.Unlock()
+		for _, listener := range s.vhostListeners {
+			listener.Close()
+		}
+		if s.vhostServer != nil {
+			s.vhostServer.Close()
+		}
+		if s.adminServer != nil {
+			s.adminServer.Close()
 		}
 	})
 
-	s := &Server{
-		config:      config,
-		listenaddrs: listenaddrs,
-		listenConns: listenConns,
+	s = &Server{
+		listeners:   make(map[string]*serverListener),
 		wg:          wg,
+		httpRouter:  newVhostRouter(),
+		httpsRouter: newVhostRouter(),
+		groups:      make(map[string]*serviceGroup),
+		ratelimits:  make(map[string]*clientRateLimit),
+		quotas:      make(map[string]*clientQuota),
+		traffic:     traffic,
+		fair:        newFairScheduler(config),
 	}
+	s.config.Store(config)
+	s.accesslog.Store(accesslog)
 
-	for i, _ := range proto {
-		index := i
-		wg.Go("Server listen"+" "+listenaddrs[i], func() error {
-			return s.listen(index)
-		})
+	err = s.listenVhost(wg)
+	if err == nil {
+		err = s.listenAdmin(wg)
+	}
+	if err != nil {
+		s.Close()
+		for _, l := range listeners {
+			l.close()
+		}
+		return nil, err
 	}
 
+	s.listenLock.Lock()
+	for _, l := range listeners {
+		s.startListen(l)
+	}
+	s.listenLock.Unlock()
+
 	wg.Go("Client state", func() error {
 		return showState(wg)
 	})
 
+	wg.Go("Server saveTrafficStats", func() error {
+		return saveTrafficStats(wg, traffic)
+	})
+
+	wg.Go("Server fairScheduler", func() error {
+		return s.fair.run(wg)
+	})
+
 	return s, nil
 }
 
 func (s *Server) Close() {
 	s.wg.Stop()
 	s.wg.Wait()
+	err := s.traffic.save()
+	if err != nil {
+		loggo.Error("Server Close save traffic stats fail %s %s", s.traffic.filename, err)
+	}
+	closeAccessLog(s.accesslog.Swap(nil))
 }
 
-func (s *Server) listen(index int) error {
-	loggo.Info("listen start %d %s", index, s.listenaddrs[index])
-	for !s.wg.IsExit() {
-		conn, err := s.listenConns[index].Accept()
+func (s *Server) getConfig() *Config {
+	return s.config.Load()
+}
+
+// 调用时要拿着listenLock
+func (s *Server) startListen(l *serverListener) {
+	s.listeners[l.key] = l
+	s.wg.Go("Server listen"+" "+l.addr, func() error {
+		return s.listen(l)
+	})
+}
+
+func (s *Server) listen(l *serverListener) error {
+	loggo.Info("listen start %s %s", l.proto, l.addr)
+	for !s.wg.IsExit() && atomic.LoadInt32(&l.closed) == 0 {
+		conn, err := l.conn.Accept()
 		if err != nil {
 			loggo.Info("Server listen Accept fail %s", err)
 			continue
 		}
 
+		config := s.getConfig()
 		size := s.clientSize()
-		if size >= s.config.MaxClient {
+		if size >= config.MaxClient {
 			loggo.Info("Server listen max client %s %d", conn.Info(), size)
 			conn.Close()
 			continue
@@ -108,10 +215,13 @@ func (s *Server) listen(index int) error {
 
 		clientconn := &ClientConn{ProxyConn: ProxyConn{conn: conn}}
 		s.wg.Go("Server serveClient"+" "+conn.Info(), func() error {
+			if !acceptProxyProtocol(conn, config) {
+				return nil
+			}
 			return s.serveClient(clientconn)
 		})
 	}
-	loggo.Info("listen end %d %s", index, s.listenaddrs[index])
+	loggo.Info("listen end %s %s", l.proto, l.addr)
 	return nil
 }
 
@@ -128,8 +238,11 @@ func (s *Server) serveClient(clientconn *ClientConn) error {
 
 	loggo.Info("serveClient accept new client %s", clientconn.conn.Info())
 
-	sendch := common.NewChannel(s.config.MainBuffer)
-	recvch := common.NewChannel(s.config.MainBuffer)
+	clientconn.config = s.getConfig()
+	clientconn.begin = time.Now()
+
+	sendch := common.NewChannel(clientconn.config.MainBuffer)
+	recvch := common.NewChannel(clientconn.config.MainBuffer)
 
 	clientconn.sendch = sendch
 	clientconn.recvch = recvch
@@ -139,7 +252,7 @@ func (s *Server) serveClient(clientconn *ClientConn) error {
 		clientconn.conn.Close()
 		sendch.Close()
 		recvch.Close()
-		if clientconn.input != nil {
+		if clientconn.input != nil && clientconn.group == nil {
 			clientconn.input.Close()
 		}
 		if clientconn.output != nil {
@@ -153,15 +266,15 @@ func (s *Server) serveClient(clientconn *ClientConn) error {
 	var pongtime int64
 
 	wg.Go("Server recvFrom"+" "+clientconn.conn.Info(), func() error {
-		return recvFrom(wg, recvch, clientconn.conn, s.config.MaxMsgSize, s.config.Encrypt)
+		return recvFrom(wg, recvch, clientconn.conn, clientconn.config.MaxMsgSize, clientconn.config.Encrypt, &clientconn.ProxyConn)
 	})
 
 	wg.Go("Server sendTo"+" "+clientconn.conn.Info(), func() error {
-		return sendTo(wg, sendch, clientconn.conn, s.config.Compress, s.config.MaxMsgSize, s.config.Encrypt, &pingflag, &pongflag, &pongtime)
+		return sendTo(wg, sendch, clientconn.conn, clientconn.config.Compress, clientconn.config.MaxMsgSize, clientconn.config.Encrypt, &pingflag, &pongflag, &pongtime, &clientconn.ProxyConn)
 	})
 
 	wg.Go("Server checkPingActive"+" "+clientconn.conn.Info(), func() error {
-		return checkPingActive(wg, sendch, recvch, &clientconn.ProxyConn, s.config.EstablishedTimeout, s.config.PingInter, s.config.PingTimeoutInter, s.config.ShowPing, &pingflag)
+		return checkPingActive(wg, sendch, recvch, &clientconn.ProxyConn, clientconn.config.EstablishedTimeout, clientconn.config.PingInter, clientconn.config.PingTimeoutInter, clientconn.config.ShowPing, &pingflag)
 	})
 
 	wg.Go("Server checkNeedClose"+" "+clientconn.conn.Info(), func() error {
@@ -173,8 +286,26 @@ func (s *Server) serveClient(clientconn *ClientConn) error {
 	})
 
 	wg.Wait()
-	if clientconn.established {
-		s.clients.Delete(clientconn.name)
+	if clientconn.vhost != nil {
+		s.vhostRouter(clientconn.vhost.scheme).remove(clientconn.vhost)
+	}
+	if clientconn.group != nil {
+		s.leaveGroup(clientconn)
+	}
+	if clientconn.established.Load() && isSecretType(clientconn.clienttype) {
+		s.closeSecret(clientconn)
+	}
+	if clientconn.established.Load() {
+		s.closeRelay(clientconn)
+	}
+	if clientconn.established.Load() {
+		s.clients.CompareAndDelete(clientconn.key, clientconn)
+		s.retired.Delete(clientconn)
+		s.traffic.offline(&clientconn.ProxyConn)
+		releaseMetrics(clientconn.getMetrics())
+		s.releaseQuota(clientconn.name, clientconn.quota)
+		s.releaseRateLimiter(clientconn.name)
+		s.fair.release(clientconn.fair.Load())
 	}
 
 	loggo.Info("serveClient close client %s", clientconn.conn.Info())
@@ -200,7 +331,7 @@ func (s *Server) process(wg *thread.Group, sendch *common.Channel, recvch *commo
 			processPing(f, sendch, &clientconn.ProxyConn, pongflag, pongtime)
 
 		case FRAME_TYPE_PONG:
-			processPong(f, sendch, &clientconn.ProxyConn, s.config.ShowPing)
+			processPong(f, sendch, &clientconn.ProxyConn, clientconn.config.ShowPing)
 
 		case FRAME_TYPE_DATA:
 			s.processData(f, clientconn)
@@ -213,6 +344,9 @@ func (s *Server) process(wg *thread.Group, sendch *common.Channel, recvch *commo
 
 		case FRAME_TYPE_CLOSE:
 			s.processClose(f, clientconn)
+
+		case FRAME_TYPE_GOAWAY:
+			loggo.Info("process ignore goaway %s", clientconn.conn.Info())
 		}
 	}
 	loggo.Info("process end %s", clientconn.conn.Info())
@@ -227,47 +361,77 @@ func (s *Server) processLogin(wg *thread.Group, f *ProxyFrame, sendch *common.Ch
 	clientconn.fromaddr = f.LoginFrame.Fromaddr
 	clientconn.toaddr = f.LoginFrame.Toaddr
 	clientconn.name = f.LoginFrame.Name
+	clientconn.secret = f.LoginFrame.Secret
+	clientconn.exit = f.LoginFrame.Exit
+	clientconn.allowexit = f.LoginFrame.Allowexit
+	clientconn.exitsecret = f.LoginFrame.Exitsecret
 
 	rf := &ProxyFrame{}
 	rf.Type = FRAME_TYPE_LOGINRSP
 	rf.LoginRspFrame = &LoginRspFrame{}
 
-	if f.LoginFrame.Key != s.config.Key {
+	if s.isDraining() {
+		rf.LoginRspFrame.Ret = false
+		rf.LoginRspFrame.Msg = "server shutdown"
+		sendch.Write(rf)
+		loggo.Info("processLogin fail server shutdown %s %s", clientconn.conn.Info(), f.LoginFrame.String())
+		return
+	}
+
+	if f.LoginFrame.Key != clientconn.config.Key {
 		rf.LoginRspFrame.Ret = false
 		rf.LoginRspFrame.Msg = "key error"
 		sendch.Write(rf)
+		metricsLoginFailed()
 		loggo.Error("processLogin fail key error %s %s", clientconn.conn.Info(), f.LoginFrame.String())
 		return
 	}
 
-	if clientconn.established {
+	if clientconn.established.Load() {
 		rf.LoginRspFrame.Ret = false
 		rf.LoginRspFrame.Msg = "has established before"
 		sendch.Write(rf)
+		metricsLoginFailed()
 		loggo.Error("processLogin fail has established before %s %s", clientconn.conn.Info(), f.LoginFrame.String())
 		return
 	}
 
-	_, loaded := s.clients.LoadOrStore(f.LoginFrame.Name, clientconn)
-	if loaded {
+	clientconn.key = f.LoginFrame.Name
+	if len(f.LoginFrame.Group) > 0 {
+		// 同一个服务组的成员通常用同样的配置启动在多台机器上
+		clientconn.key = f.LoginFrame.Name + " " + clientconn.conn.Info()
+	}
+
+	old, loaded := s.clients.LoadOrStore(clientconn.key, clientconn)
+	if loaded && !s.replaceGoaway(old.(*ClientConn), clientconn) {
 		rf.LoginRspFrame.Ret = false
 		rf.LoginRspFrame.Msg = f.LoginFrame.Name + " has login before"
 		sendch.Write(rf)
+		metricsLoginFailed()
 		loggo.Error("processLogin fail %s has login before %s %s", f.LoginFrame.Name, clientconn.conn.Info(), f.LoginFrame.String())
 		return
 	}
 
 	err := s.iniService(wg, f, clientconn)
 	if err != nil {
-		s.clients.Delete(clientconn.name)
+		s.clients.CompareAndDelete(clientconn.key, clientconn)
 		rf.LoginRspFrame.Ret = false
 		rf.LoginRspFrame.Msg = "iniService fail"
 		sendch.Write(rf)
+		metricsLoginFailed()
 		loggo.Error("processLogin iniService fail %s %s %s", clientconn.conn.Info(), f.LoginFrame.String(), err)
 		return
 	}
 
-	clientconn.established = true
+	clientconn.role = "server"
+	clientconn.loginname = clientconn.name
+	clientconn.quota = s.acquireQuota(clientconn.name)
+	clientconn.established.Store(true)
+	// 登录成功以后才有label，名字等不会被没登录的连接随便撑大
+	clientconn.metrics.Store(getMetrics("server", clientconn.name, clientconn.fromaddr, clientconn.toaddr, clientconn.proxyproto))
+	clientconn.ratelimit.Store(s.acquireRateLimiter(clientconn.name))
+	clientconn.fair.Store(s.fair.flow(clientconn.config, fairFlowName(clientconn.config, clientconn)))
+	s.traffic.online(clientconn.name, &clientconn.ProxyConn)
 
 	rf.LoginRspFrame.Ret = true
 	rf.LoginRspFrame.Msg = "ok"
@@ -277,44 +441,118 @@ func (s *Server) processLogin(wg *thread.Group, f *ProxyFrame, sendch *common.Ch
 }
 
 func (s *Server) iniService(wg *thread.Group, f *ProxyFrame, clientConn *ClientConn) error {
+	err := checkProxyProtocol(f.LoginFrame.Proxyprotocol)
+	if err != nil {
+		return err
+	}
+
 	switch f.LoginFrame.Clienttype {
 	case CLIENT_TYPE_PROXY:
-		output, err := NewOutputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn)
+		output, err := NewOutputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Clienttype, clientConn.config, &clientConn.ProxyConn)
 		if err != nil {
 			return err
 		}
 		clientConn.output = output
 	case CLIENT_TYPE_REVERSE_PROXY:
-		input, err := NewInputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Fromaddr, f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn, clientConn.toaddr)
+		if len(f.LoginFrame.Group) > 0 {
+			return s.joinGroup(f, clientConn)
+		}
+		if isVhostAddr(f.LoginFrame.Fromaddr) {
+			return s.iniVhost(wg, f, clientConn)
+		}
+		input, err := NewInputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Fromaddr, f.LoginFrame.Clienttype, clientConn.config, &clientConn.ProxyConn, clientConn.toaddr)
 		if err != nil {
 			return err
 		}
 		clientConn.input = input
 	case CLIENT_TYPE_SOCKS5:
-		output, err := NewOutputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn)
+		output, err := NewOutputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Clienttype, clientConn.config, &clientConn.ProxyConn)
 		if err != nil {
 			return err
 		}
 		clientConn.output = output
 	case CLIENT_TYPE_REVERSE_SOCKS5:
-		input, err := NewSocks5Inputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Fromaddr, f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn)
+		input, err := NewSocks5Inputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Fromaddr, f.LoginFrame.Clienttype, clientConn.config, &clientConn.ProxyConn)
 		if err != nil {
 			return err
 		}
 		clientConn.input = input
 	case CLIENT_TYPE_SS_PROXY:
-		output, err := NewSSOutputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Clienttype, s.config, &clientConn.ProxyConn)
+		output, err := NewSSOutputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Clienttype, clientConn.config, &clientConn.ProxyConn)
+		if err != nil {
+			return err
+		}
+		clientConn.output = output
+	case CLIENT_TYPE_HTTP_PROXY:
+		output, err := NewOutputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Clienttype, clientConn.config, &clientConn.ProxyConn)
+		if err != nil {
+			return err
+		}
+		clientConn.output = output
+	case CLIENT_TYPE_REVERSE_HTTP_PROXY:
+		input, err := NewHttpProxyInputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Fromaddr, f.LoginFrame.Clienttype, clientConn.config, &clientConn.ProxyConn)
+		if err != nil {
+			return err
+		}
+		clientConn.input = input
+	case CLIENT_TYPE_TRANSPARENT:
+		output, err := NewOutputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Clienttype, clientConn.config, &clientConn.ProxyConn)
 		if err != nil {
 			return err
 		}
 		clientConn.output = output
+	case CLIENT_TYPE_SECRET:
+		return s.iniSecret(clientConn)
+	case CLIENT_TYPE_SECRET_VISITOR:
+		return nil
 	default:
 		return errors.New("error CLIENT_TYPE " + strconv.Itoa(int(f.LoginFrame.Clienttype)))
 	}
+	// server上的Outputer按client的配置发PROXY protocol头
+	if clientConn.output != nil {
+		clientConn.output.proxyprotocol = f.LoginFrame.Proxyprotocol
+	}
 	return nil
 }
 
+func (s *Server) iniVhost(wg *thread.Group, f *ProxyFrame, clientConn *ClientConn) error {
+	scheme, _, path, _ := parseVhostAddr(f.LoginFrame.Fromaddr)
+	if (scheme == "http" && len(s.getConfig().VhostHttp) <= 0) || (scheme == "https" && len(s.getConfig().VhostHttps) <= 0) {
+		return errors.New("no vhost " + scheme + " listen")
+	}
+	if scheme == "https" && path != "/" {
+		// https只能看到SNI，看不到路径
+		return errors.New("https vhost not support path " + path)
+	}
+
+	input, err := NewVhostInputer(wg, f.LoginFrame.Proxyproto.String(), f.LoginFrame.Fromaddr, f.LoginFrame.Clienttype, clientConn.config, &clientConn.ProxyConn, clientConn.toaddr)
+	if err != nil {
+		return err
+	}
+
+	route := newVhostRoute(clientConn.name, f.LoginFrame.Fromaddr, input, clientConn.toaddr)
+	err = s.vhostRouter(scheme).add(route)
+	if err != nil {
+		input.Close()
+		return err
+	}
+
+	clientConn.input = input
+	clientConn.vhost = route
+	return nil
+}
+
+func (s *Server) vhostRouter(scheme string) *vhostRouter {
+	if scheme == "https" {
+		return s.httpsRouter
+	}
+	return s.httpRouter
+}
+
 func (s *Server) processData(f *ProxyFrame, clientconn *ClientConn) {
+	if s.relayFrame(f.DataFrame.Id, f, clientconn) {
+		return
+	}
 	if clientconn.input != nil {
 		clientconn.input.processDataFrame(f)
 	} else if clientconn.output != nil {
@@ -323,18 +561,33 @@ func (s *Server) processData(f *ProxyFrame, clientconn *ClientConn) {
 }
 
 func (s *Server) processOpenRsp(f *ProxyFrame, clientconn *ClientConn) {
+	if s.relayFrame(f.OpenRspFrame.Id, f, clientconn) {
+		return
+	}
 	if clientconn.input != nil {
 		clientconn.input.processOpenRspFrame(f)
 	}
 }
 
 func (c *Server) processOpen(f *ProxyFrame, clientconn *ClientConn) {
-	if clientconn.output != nil {
+	if c.isDraining() {
+		rejectOpen(f, &clientconn.ProxyConn, "server shutdown")
+	} else if msg := c.checkOpenQuota(clientconn); len(msg) > 0 {
+		rejectOpen(f, &clientconn.ProxyConn, msg)
+		clientconn.getMetrics().openRejected()
+	} else if clientconn.clienttype == CLIENT_TYPE_SECRET_VISITOR {
+		c.openSecret(f, clientconn)
+	} else if len(clientconn.exit) > 0 {
+		c.openExit(f, clientconn)
+	} else if clientconn.output != nil {
 		clientconn.output.processOpenFrame(f)
 	}
 }
 
 func (c *Server) processClose(f *ProxyFrame, clientconn *ClientConn) {
+	if c.relayFrame(f.CloseFrame.Id, f, clientconn) {
+		return
+	}
 	if clientconn.input != nil {
 		clientconn.input.processCloseFrame(f)
 	} else if clientconn.output != nil {
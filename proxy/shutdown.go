@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// 对端发来的OPEN直接回失败，对端的Inputer收到就关掉本地连接
+func rejectOpen(f *ProxyFrame, father *ProxyConn, msg string) {
+	rf := &ProxyFrame{}
+	rf.Type = FRAME_TYPE_OPENRSP
+	rf.OpenRspFrame = &OpenConnRspFrame{}
+	rf.OpenRspFrame.Id = f.OpenFrame.Id
+	rf.OpenRspFrame.Ret = false
+	rf.OpenRspFrame.Msg = msg
+	father.sendch.Write(rf)
+	loggo.Info("rejectOpen %s %s", f.OpenFrame.Id, msg)
+}
+
+// 定时看剩下的连接数，都结束了或者超时就返回
+func waitDrain(name string, timeout time.Duration, size func() int) {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	deadline := time.After(timeout)
+	for {
+		n := size()
+		if n <= 0 {
+			loggo.Info("%s drain ok", name)
+			return
+		}
+		select {
+		case <-deadline:
+			loggo.Info("%s drain timeout %d", name, n)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+// 优雅关闭，不再接受新的client和连接，等已有的连接结束，最多等ShutdownTimeout秒，然后关掉主通道，对端马上就能去重连
+func (s *Server) Shutdown() {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return
+	}
+	timeout := time.Duration(s.getConfig().ShutdownTimeout) * time.Second
+	loggo.Info("Server Shutdown start %s", timeout)
+
+	// 有别的服务器的client马上换过去，新的连接不用等这边关掉
+	s.clients.Range(func(key, value interface{}) bool {
+		s.sendGoaway(value.(*ClientConn), "server shutdown", "", "")
+		return true
+	})
+
+	s.listenLock.Lock()
+	for _, l := range s.listeners {
+		l.close()
+	}
+	s.listenLock.Unlock()
+
+	for _, listener := range s.vhostListeners {
+		listener.Close()
+	}
+	if s.vhostServer != nil {
+		s.vhostServer.SetKeepAlivesEnabled(false)
+	}
+
+	s.groupLock.Lock()
+	for _, g := range s.groups {
+		g.input.Close()
+	}
+	s.groupLock.Unlock()
+
+	s.clients.Range(func(key, value interface{}) bool {
+		clientconn := value.(*ClientConn)
+		if clientconn.input != nil && clientconn.group == nil {
+			clientconn.input.Close()
+		}
+		return true
+	})
+
+	waitDrain("Server Shutdown", timeout, s.streamSize)
+
+	s.Close()
+	loggo.Info("Server Shutdown end")
+}
+
+func (s *Server) streamSize() int {
+	size := 0
+	count := func(key, value interface{}) bool {
+		s.rangeStreams(value.(*ClientConn), func(stream AdminStream, closefunc func()) bool {
+			size++
+			return true
+		})
+		return true
+	}
+	s.clients.Range(count)
+	s.retired.Range(func(key, value interface{}) bool {
+		return count(nil, key)
+	})
+	return size
+}
+
+func (c *Client) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) != 0
+}
+
+// 优雅关闭，关掉本地监听，不再接受server发来的OPEN，断线也不重连，等已有的连接结束，最多等ShutdownTimeout秒
+func (c *Client) Shutdown() {
+	if !atomic.CompareAndSwapInt32(&c.draining, 0, 1) {
+		return
+	}
+	timeout := time.Duration(c.config.ShutdownTimeout) * time.Second
+	loggo.Info("Client Shutdown start %s %s", c.name, timeout)
+
+	for _, sc := range c.serverConns() {
+		if sc.input != nil {
+			sc.input.Close()
+		}
+	}
+
+	waitDrain("Client Shutdown "+c.name, timeout, c.streamSize)
+
+	c.Close()
+	loggo.Info("Client Shutdown end %s", c.name)
+}
+
+func (c *Client) streamSize() int {
+	size := 0
+	for _, sc := range c.serverConns() {
+		if sc.input != nil {
+			size += sc.input.sonnySize()
+		}
+		if sc.output != nil {
+			size += sc.output.sonnySize()
+		}
+	}
+	return size
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func Test0022Shutdown(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	echo := startEcho(t, "tcp", "127.0.0.1:33802")
+	defer echo.Close()
+
+	config := DefaultConfig()
+	config.ShutdownTimeout = 20
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:33800"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 本地连接关掉以后等不活跃超时才结束，checkSonnyActive过了EstablishedTimeout才开始算
+	cconfig := DefaultConfig()
+	cconfig.EstablishedTimeout = 2
+	cconfig.ConnTimeout = 2
+	c, err := NewClient(cconfig, "tcp", "127.0.0.1:33800", "test_shutdown", "PROXY", []string{"tcp"}, []string{"127.0.0.1:33803"}, []string{"127.0.0.1:33802"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c2config := DefaultConfig()
+	c2config.ShutdownTimeout = 2
+	c2, err := NewClient(c2config, "tcp", "127.0.0.1:33800", "test_shutdown2", "PROXY", []string{"tcp"}, []string{"127.0.0.1:33804"}, []string{"127.0.0.1:33802"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	if err := checkEcho("tcp", "127.0.0.1:33803", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEcho("tcp", "127.0.0.1:33804", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// client关闭时不再接受本地连接，已有的连接等到超时
+	conn2, err := net.Dial("tcp", "127.0.0.1:33804")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if err := echoOnce(conn2, []byte("hello spp shutdown client")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan time.Time, 1)
+	begin := time.Now()
+	go func() {
+		c2.Shutdown()
+		done <- time.Now()
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	if _, err := net.DialTimeout("tcp", "127.0.0.1:33804", time.Second); err == nil {
+		t.Fatal("client listen should be closed")
+	}
+	if err := echoOnce(conn2, []byte("hello spp shutdown client drain")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case end := <-done:
+		if end.Sub(begin) < 2*time.Second {
+			t.Fatal("client shutdown too early", end.Sub(begin))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("client shutdown timeout")
+	}
+
+	// server关闭时拒绝新的登录和连接，已有的连接结束就关掉主通道
+	conn, err := net.Dial("tcp", "127.0.0.1:33803")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := echoOnce(conn, []byte("hello spp shutdown server")); err != nil {
+		t.Fatal(err)
+	}
+
+	begin = time.Now()
+	go func() {
+		s.Shutdown()
+		done <- time.Now()
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	if _, err := net.DialTimeout("tcp", "127.0.0.1:33800", time.Second); err == nil {
+		t.Fatal("server listen should be closed")
+	}
+	if err := tryEcho("tcp", "127.0.0.1:33803"); err == nil {
+		t.Fatal("new stream should be refused")
+	}
+	if err := echoOnce(conn, []byte("hello spp shutdown server drain")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case end := <-done:
+		if end.Sub(begin) >= time.Duration(config.ShutdownTimeout)*time.Second {
+			t.Fatal("server shutdown not drained", end.Sub(begin))
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("server shutdown timeout")
+	}
+
+	// client马上发现主通道断了，不用等ping超时
+	begin = time.Now()
+	for c.getServerConn(0) != nil && time.Since(begin) < 3*time.Second {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if c.getServerConn(0) != nil {
+		t.Fatal("client not notice server shutdown")
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	SOCKS4_VERSION = 0x04
+
+	SOCKS4_CMD_CONNECT = 0x01
+
+	SOCKS4_REP_GRANTED       = 0x5a
+	SOCKS4_REP_REJECTED      = 0x5b
+	SOCKS4_REP_USERID_FAILED = 0x5d
+
+	MAX_SOCKS4_FIELD_SIZE = 256
+)
+
+// 版本号已经读走，读取 CD DSTPORT DSTIP USERID [DOMAIN]，DSTIP为0.0.0.x时是socks4a
+func socks4ReadRequest(r io.Reader) (byte, string, string, error) {
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, "", "", err
+	}
+	cmd := buf[0]
+	port := binary.BigEndian.Uint16(buf[1:3])
+	ip := net.IP(buf[3:7])
+
+	userid, err := socks4ReadString(r)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err = socks4ReadString(r)
+		if err != nil {
+			return 0, "", "", err
+		}
+	}
+
+	return cmd, userid, net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func socks4ReadString(r io.Reader) (string, error) {
+	var sb strings.Builder
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return sb.String(), nil
+		}
+		if sb.Len() >= MAX_SOCKS4_FIELD_SIZE {
+			return "", errors.New("socks4 field too long")
+		}
+		sb.WriteByte(b[0])
+	}
+}
+
+func socks4WriteReply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{0x00, rep, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	return err
+}
+
+// socks4只有userid，配置了密码时userid需要写成 用户名:密码
+func socks4CheckUserid(userid string, checkUser func(user string, password string) bool) (string, bool) {
+	user, password, _ := strings.Cut(userid, ":")
+	return user, checkUser(user, password)
+}
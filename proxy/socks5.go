@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	SOCKS5_VERSION = 0x05
+
+	SOCKS5_METHOD_NO_AUTH       = 0x00
+	SOCKS5_METHOD_USER_PASS     = 0x02
+	SOCKS5_METHOD_NO_ACCEPTABLE = 0xff
+
+	SOCKS5_CMD_CONNECT       = 0x01
+	SOCKS5_CMD_BIND          = 0x02
+	SOCKS5_CMD_UDP_ASSOCIATE = 0x03
+
+	SOCKS5_ATYP_IPV4   = 0x01
+	SOCKS5_ATYP_DOMAIN = 0x03
+	SOCKS5_ATYP_IPV6   = 0x04
+
+	SOCKS5_REP_SUCCESS           = 0x00
+	SOCKS5_REP_FAIL              = 0x01
+	SOCKS5_REP_CMD_NOT_SUPPORTED = 0x07
+)
+
+// 版本号已经读走，读取 NMETHODS METHODS，需要时再做用户名密码校验，返回登录的用户名
+func socks5ServerHandshake(rw io.ReadWriter, checkUser func(user string, password string) bool, needauth bool) (string, error) {
+	n := make([]byte, 1)
+	if _, err := io.ReadFull(rw, n); err != nil {
+		return "", err
+	}
+	methods := make([]byte, n[0])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+
+	if !needauth {
+		if bytes.IndexByte(methods, SOCKS5_METHOD_NO_AUTH) < 0 {
+			rw.Write([]byte{SOCKS5_VERSION, SOCKS5_METHOD_NO_ACCEPTABLE})
+			return "", errors.New("socks5 no no-auth method")
+		}
+		_, err := rw.Write([]byte{SOCKS5_VERSION, SOCKS5_METHOD_NO_AUTH})
+		return "", err
+	}
+
+	if bytes.IndexByte(methods, SOCKS5_METHOD_USER_PASS) < 0 {
+		rw.Write([]byte{SOCKS5_VERSION, SOCKS5_METHOD_NO_ACCEPTABLE})
+		return "", errors.New("socks5 no user pass method")
+	}
+	if _, err := rw.Write([]byte{SOCKS5_VERSION, SOCKS5_METHOD_USER_PASS}); err != nil {
+		return "", err
+	}
+
+	// VER ULEN UNAME PLEN PASSWD
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return "", err
+	}
+	if header[0] != 0x01 {
+		return "", errors.New("socks5 auth version error " + strconv.Itoa(int(header[0])))
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(rw, user); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(rw, header[:1]); err != nil {
+		return "", err
+	}
+	password := make([]byte, header[0])
+	if _, err := io.ReadFull(rw, password); err != nil {
+		return "", err
+	}
+
+	if !checkUser(string(user), string(password)) {
+		rw.Write([]byte{0x01, 0x01})
+		return "", errors.New("socks5 auth fail " + string(user))
+	}
+	if _, err := rw.Write([]byte{0x01, 0x00}); err != nil {
+		return "", err
+	}
+	return string(user), nil
+}
+
+// 读取 VER CMD RSV ATYP DST.ADDR DST.PORT
+func socks5ReadRequest(r io.Reader) (byte, string, error) {
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, "", err
+	}
+	if buf[0] != SOCKS5_VERSION {
+		return 0, "", errors.New("socks5 version error " + strconv.Itoa(int(buf[0])))
+	}
+	addr, err := socks5ReadAddr(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return buf[1], addr, nil
+}
+
+func socks5ReadAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case SOCKS5_ATYP_IPV4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case SOCKS5_ATYP_IPV6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case SOCKS5_ATYP_DOMAIN:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return "", err
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errors.New("socks5 addr type error " + strconv.Itoa(int(atyp[0])))
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func socks5AppendAddr(b []byte, addr string) ([]byte, error) {
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, SOCKS5_ATYP_IPV4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, SOCKS5_ATYP_IPV6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks5 domain too long " + host)
+		}
+		b = append(b, SOCKS5_ATYP_DOMAIN, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+func socks5WriteReply(w io.Writer, rep byte, addr string) error {
+	if addr == "" {
+		addr = "0.0.0.0:0"
+	}
+	b, err := socks5AppendAddr([]byte{SOCKS5_VERSION, rep, 0x00}, addr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// udp数据报格式 RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+func socks5UnpackUdp(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("socks5 udp too short")
+	}
+	if b[2] != 0 {
+		return "", nil, errors.New("socks5 udp frag not supported")
+	}
+	r := bytes.NewReader(b[3:])
+	addr, err := socks5ReadAddr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, b[len(b)-r.Len():], nil
+}
+
+func socks5PackUdp(addr string, data []byte) ([]byte, error) {
+	b, err := socks5AppendAddr([]byte{0x00, 0x00, 0x00}, addr)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, data...), nil
+}
@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func startUdpEcho(t *testing.T, addr string) *net.UDPConn {
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", uaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn
+}
+
+func socks5UdpAssociate(socksaddr string) (net.Conn, *net.UDPAddr, error) {
+	conn, err := net.Dial("tcp", socksaddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	req, _ := socks5AppendAddr([]byte{0x05, SOCKS5_CMD_UDP_ASSOCIATE, 0x00}, "0.0.0.0:0")
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	rep, addr, err := socks5ReadRequest(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if rep != SOCKS5_REP_SUCCESS {
+		conn.Close()
+		return nil, nil, echoError("udp associate fail")
+	}
+	conn.SetDeadline(time.Time{})
+
+	relay, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, relay, nil
+}
+
+func checkSocks5Udp(socksaddr string, target string, timeout time.Duration) error {
+	var err error
+	begin := time.Now()
+	for time.Since(begin) < timeout {
+		err = trySocks5Udp(socksaddr, target)
+		if err == nil {
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return err
+}
+
+func trySocks5Udp(socksaddr string, target string) error {
+	control, relay, err := socks5UdpAssociate(socksaddr)
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	src := []byte("hello spp udp associate")
+	b, err := socks5PackUdp(target, src)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 65536)
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			continue
+		}
+		from, data, err := socks5UnpackUdp(buf[:n])
+		if err != nil {
+			return err
+		}
+		if from != target || !bytes.Equal(data, src) {
+			return errEchoMismatch
+		}
+		return nil
+	}
+	return errEchoTimeout
+}
+
+func trySocks5Connect(socksaddr string, target string) error {
+	conn, err := net.Dial("tcp", socksaddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+
+	req, _ := socks5AppendAddr([]byte{0x05, SOCKS5_CMD_CONNECT, 0x00}, target)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	rep, _, err := socks5ReadRequest(conn)
+	if err != nil {
+		return err
+	}
+	if rep != SOCKS5_REP_SUCCESS {
+		return echoError("connect fail")
+	}
+
+	src := []byte("hello spp socks5 connect")
+	if _, err := conn.Write(src); err != nil {
+		return err
+	}
+	dst := make([]byte, len(src))
+	if _, err := io.ReadFull(conn, dst); err != nil {
+		return err
+	}
+	if !bytes.Equal(src, dst) {
+		return errEchoMismatch
+	}
+	return nil
+}
+
+func Test0005Socks5UdpAssociate(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	echo := startUdpEcho(t, "127.0.0.1:32202")
+	defer echo.Close()
+
+	tcpecho := startEcho(t, "tcp", "127.0.0.1:32202")
+	defer tcpecho.Close()
+
+	config := DefaultConfig()
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:32200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := NewClient(config, "tcp", "127.0.0.1:32200", "test_socks5", "SOCKS5", []string{"tcp"}, []string{"127.0.0.1:32201"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := checkSocks5Udp("127.0.0.1:32201", "127.0.0.1:32202", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := trySocks5Connect("127.0.0.1:32201", "127.0.0.1:32202"); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := NewClient(config, "tcp", "127.0.0.1:32200", "test_reverse_socks5", "REVERSE_SOCKS5", []string{"tcp"}, []string{"127.0.0.1:32203"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	if err := checkSocks5Udp("127.0.0.1:32203", "127.0.0.1:32202", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 往很多目标发时解析过的地址不会一直涨
+	addrs := newUdpAddrCache()
+	for i := 0; i < UDP_ADDR_CACHE_SIZE*2; i++ {
+		if _, err := addrs.resolve("127.0.0.1:" + strconv.Itoa(10000+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(addrs.addrs) > UDP_ADDR_CACHE_SIZE {
+		t.Fatal("udp addr cache not bounded", len(addrs.addrs))
+	}
+
+	// 没开认证时client没提供无认证的方法，回0xff
+	conn, err := net.Dial("tcp", "127.0.0.1:32201")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte{SOCKS5_VERSION, 0x01, SOCKS5_METHOD_USER_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	rsp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, rsp); err != nil || rsp[1] != SOCKS5_METHOD_NO_ACCEPTABLE {
+		t.Fatal("no acceptable method error", rsp, err)
+	}
+}
+
+func trySocks4Connect(socksaddr string, userid string, host string, port int) error {
+	conn, err := net.Dial("tcp", socksaddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	req := []byte{0x04, SOCKS4_CMD_CONNECT, byte(port >> 8), byte(port)}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		// socks4a
+		req = append(req, 0, 0, 0, 1)
+	} else {
+		req = append(req, ip...)
+	}
+	req = append(req, userid...)
+	req = append(req, 0)
+	if ip == nil {
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	rsp := make([]byte, 8)
+	if _, err := io.ReadFull(conn, rsp); err != nil {
+		return err
+	}
+	if rsp[1] != SOCKS4_REP_GRANTED {
+		return echoError("socks4 rejected")
+	}
+
+	src := []byte("hello spp socks4 connect")
+	if _, err := conn.Write(src); err != nil {
+		return err
+	}
+	dst := make([]byte, len(src))
+	if _, err := io.ReadFull(conn, dst); err != nil {
+		return err
+	}
+	if !bytes.Equal(src, dst) {
+		return errEchoMismatch
+	}
+	return nil
+}
+
+func Test0006Socks4(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	tcpecho := startEcho(t, "tcp", "127.0.0.1:32302")
+	defer tcpecho.Close()
+
+	config := DefaultConfig()
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:32300"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cconfig := DefaultConfig()
+	cconfig.Username = "user"
+	cconfig.Password = "pass"
+	c, err := NewClient(cconfig, "tcp", "127.0.0.1:32300", "test_socks4", "SOCKS5", []string{"tcp"}, []string{"127.0.0.1:32301"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var lasterr error
+	begin := time.Now()
+	for time.Since(begin) < 10*time.Second {
+		lasterr = trySocks4Connect("127.0.0.1:32301", "user:pass", "127.0.0.1", 32302)
+		if lasterr == nil {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if lasterr != nil {
+		t.Fatal(lasterr)
+	}
+
+	if err := trySocks4Connect("127.0.0.1:32301", "user:pass", "localhost", 32302); err != nil {
+		t.Fatal("socks4a", err)
+	}
+
+	if err := trySocks4Connect("127.0.0.1:32301", "user:wrong", "127.0.0.1", 32302); err == nil {
+		t.Fatal("socks4 wrong userid should fail")
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:32301")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{0x05, 0x01, SOCKS5_METHOD_USER_PASS, 0x01, 0x04, 'u', 's', 'e', 'r', 0x05, 'w', 'r', 'o', 'n', 'g'})
+	rsp := make([]byte, 4)
+	if _, err := io.ReadFull(conn, rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp[3] == 0x00 {
+		t.Fatal("socks5 wrong password should fail")
+	}
+}
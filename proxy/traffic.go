@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/thread"
+)
+
+// Inputer Outputer上所有连接的累计
+type streamCounter struct {
+	recvsize int64 // 从本地连接读到的字节
+	sendsize int64 // 写给本地连接的字节
+	streams  int64 // 开过的连接数
+}
+
+// Inputer Outputer的流量
+type StreamStats struct {
+	RecvBytes int64 `json:"recv_bytes"`
+	SendBytes int64 `json:"send_bytes"`
+	Streams   int64 `json:"streams"`
+}
+
+func (c *streamCounter) stats() StreamStats {
+	return StreamStats{
+		RecvBytes: atomic.LoadInt64(&c.recvsize),
+		SendBytes: atomic.LoadInt64(&c.sendsize),
+		Streams:   atomic.LoadInt64(&c.streams),
+	}
+}
+
+func (c *streamCounter) open(father *ProxyConn) {
+	atomic.AddInt64(&c.streams, 1)
+	atomic.AddInt64(&father.streams, 1)
+	father.getMetrics().streamOpen()
+}
+
+func (c *streamCounter) close(father *ProxyConn) {
+	father.getMetrics().streamClose()
+}
+
+func (c *streamCounter) recv(father *ProxyConn, size int64) {
+	atomic.AddInt64(&c.recvsize, size)
+	atomic.AddInt64(&father.streamrecvsize, size)
+}
+
+func (c *streamCounter) send(sonny *ProxyConn, size int64) {
+	atomic.AddInt64(&sonny.sendsize, size)
+	atomic.AddInt64(&c.sendsize, size)
+	if sonny.father != nil {
+		atomic.AddInt64(&sonny.father.streamsendsize, size)
+	}
+}
+
+func (i *Inputer) Stats() StreamStats {
+	return i.counter.stats()
+}
+
+func (o *Outputer) Stats() StreamStats {
+	return o.counter.stats()
+}
+
+// 按client名字累计的流量，断线重连和重启都接着算
+type TrafficStats struct {
+	Name            string `json:"name"`
+	RecvBytes       int64  `json:"recv_bytes"`        // 主通道收到的字节
+	SendBytes       int64  `json:"send_bytes"`        // 主通道发出的字节
+	StreamRecvBytes int64  `json:"stream_recv_bytes"` // 连接上从本地读到的字节
+	StreamSendBytes int64  `json:"stream_send_bytes"` // 连接上写给本地的字节
+	Streams         int64  `json:"streams"`           // 开过的连接数
+	ThrottledMs     int64  `json:"throttled_ms"`      // 因为限速等的毫秒
+	Online          bool   `json:"online"`
+}
+
+func (t *TrafficStats) add(p *ProxyConn) {
+	t.RecvBytes += atomic.LoadInt64(&p.recvsize)
+	t.SendBytes += atomic.LoadInt64(&p.sendsize)
+	t.StreamRecvBytes += atomic.LoadInt64(&p.streamrecvsize)
+	t.StreamSendBytes += atomic.LoadInt64(&p.streamsendsize)
+	t.Streams += atomic.LoadInt64(&p.streams)
+	t.ThrottledMs += atomic.LoadInt64(&p.throttled) / int64(time.Millisecond)
+}
+
+type trafficFile struct {
+	Since   time.Time                `json:"since"`
+	Clients map[string]*TrafficStats `json:"clients"`
+}
+
+type trafficTotals struct {
+	lock     sync.Mutex
+	filename string
+	since    time.Time
+	clients  map[string]*TrafficStats // 已经断开的连接加上文件里读出来的
+	lives    map[*ProxyConn]string    // 在线的主通道 -> 名字
+}
+
+var gTrafficFiles = make(map[string]*trafficTotals)
+var gTrafficFilesLock sync.Mutex
+
+// 同一个文件在进程里只有一份，配置文件里多个隧道写同一个文件不会互相覆盖
+func getTrafficTotals(filename string) (*trafficTotals, error) {
+	if len(filename) <= 0 {
+		return newTrafficTotals(""), nil
+	}
+
+	gTrafficFilesLock.Lock()
+	defer gTrafficFilesLock.Unlock()
+
+	if t, ok := gTrafficFiles[filename]; ok {
+		return t, nil
+	}
+
+	t := newTrafficTotals(filename)
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		var tf trafficFile
+		err = json.Unmarshal(data, &tf)
+		if err != nil {
+			return nil, err
+		}
+		if !tf.Since.IsZero() {
+			t.since = tf.Since
+		}
+		for name, stats := range tf.Clients {
+			stats.Name = name
+			stats.Online = false
+			t.clients[name] = stats
+		}
+		loggo.Info("load traffic stats %s %d", filename, len(t.clients))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	gTrafficFiles[filename] = t
+	return t, nil
+}
+
+func newTrafficTotals(filename string) *trafficTotals {
+	return &trafficTotals{
+		filename: filename,
+		since:    time.Now(),
+		clients:  make(map[string]*TrafficStats),
+		lives:    make(map[*ProxyConn]string),
+	}
+}
+
+func (t *trafficTotals) online(name string, p *ProxyConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.lives[p] = name
+}
+
+// 主通道断了，把它的计数并到名字的累计里
+func (t *trafficTotals) offline(p *ProxyConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	name, ok := t.lives[p]
+	if !ok {
+		return
+	}
+	delete(t.lives, p)
+
+	stats, ok := t.clients[name]
+	if !ok {
+		stats = &TrafficStats{Name: name}
+		t.clients[name] = stats
+	}
+	stats.add(p)
+}
+
+// match为nil时返回所有名字
+func (t *trafficTotals) snapshot(match func(name string) bool) []*TrafficStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	m := make(map[string]*TrafficStats)
+	for name, stats := range t.clients {
+		s := *stats
+		m[name] = &s
+	}
+	for p, name := range t.lives {
+		s, ok := m[name]
+		if !ok {
+			s = &TrafficStats{Name: name}
+			m[name] = s
+		}
+		s.add(p)
+		s.Online = true
+	}
+
+	var ret []*TrafficStats
+	for name, s := range m {
+		if match == nil || match(name) {
+			ret = append(ret, s)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// 先写临时文件再改名，写到一半挂掉不会把旧数据弄坏
+func (t *trafficTotals) save() error {
+	if len(t.filename) <= 0 {
+		return nil
+	}
+
+	tf := trafficFile{Since: t.since, Clients: make(map[string]*TrafficStats)}
+	for _, s := range t.snapshot(nil) {
+		s.Online = false
+		tf.Clients[s.Name] = s
+	}
+	data, err := json.MarshalIndent(&tf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.filename), filepath.Base(t.filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), t.filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func saveTrafficStats(wg *thread.Group, t *trafficTotals) error {
+	if len(t.filename) <= 0 {
+		return nil
+	}
+	loggo.Info("saveTrafficStats start %s", t.filename)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	exit := false
+	for !exit {
+		select {
+		case <-wg.Done():
+			exit = true
+			break
+
+		case <-ticker.C:
+			err := t.save()
+			if err != nil {
+				loggo.Error("saveTrafficStats fail %s %s", t.filename, err)
+			}
+		}
+	}
+	loggo.Info("saveTrafficStats end %s", t.filename)
+	return nil
+}
+
+// 每个client名字的累计流量，包括已经断开的，配了stats-file时包括以前的
+func (s *Server) Stats() []*TrafficStats {
+	return s.traffic.snapshot(nil)
+}
+
+// 这个client每个连接的累计流量，名字是name_序号
+func (c *Client) Stats() []*TrafficStats {
+	return c.traffic.snapshot(func(name string) bool {
+		index, ok := strings.CutPrefix(name, c.name+"_")
+		if !ok {
+			return false
+		}
+		for i := range c.fromaddr {
+			if index == strconv.Itoa(i) {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func findTrafficStats(stats []*TrafficStats, name string) *TrafficStats {
+	for _, s := range stats {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func Test0020Traffic(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	echo := startEcho(t, "tcp", "127.0.0.1:33602")
+	defer echo.Close()
+
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.StatsFile = filepath.Join(dir, "server.json")
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:33600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cconfig := DefaultConfig()
+	cconfig.StatsFile = filepath.Join(dir, "client.json")
+	c, err := NewClient(cconfig, "tcp", "127.0.0.1:33600", "test_traffic", "PROXY", []string{"tcp"}, []string{"127.0.0.1:33603"}, []string{"127.0.0.1:33602"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkEcho("tcp", "127.0.0.1:33603", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := tryEcho("tcp", "127.0.0.1:33603"); err != nil {
+		t.Fatal(err)
+	}
+
+	ss := findTrafficStats(s.Stats(), "test_traffic_0")
+	if ss == nil || !ss.Online || ss.RecvBytes <= 0 || ss.SendBytes <= 0 || ss.Streams < 2 || ss.StreamRecvBytes <= 0 || ss.StreamSendBytes <= 0 {
+		t.Fatal("server stats error", ss)
+	}
+	cs := c.Stats()
+	if len(cs) != 1 || cs[0].Name != "test_traffic_0" || !cs[0].Online || cs[0].Streams < 2 || cs[0].StreamRecvBytes != ss.StreamSendBytes {
+		t.Fatal("client stats error", cs, ss)
+	}
+
+	// client断开后累计还在
+	c.Close()
+	var offline *TrafficStats
+	begin := time.Now()
+	for time.Since(begin) < 10*time.Second {
+		offline = findTrafficStats(s.Stats(), "test_traffic_0")
+		if offline != nil && !offline.Online {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if offline == nil || offline.Online || offline.RecvBytes < ss.RecvBytes || offline.Streams != ss.Streams {
+		t.Fatal("offline stats error", offline, ss)
+	}
+	s.Close()
+
+	// 模拟重启，从文件里读出来
+	gTrafficFilesLock.Lock()
+	delete(gTrafficFiles, config.StatsFile)
+	gTrafficFilesLock.Unlock()
+
+	s, err = NewServer(config, []string{"tcp"}, []string{"127.0.0.1:33600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	loaded := findTrafficStats(s.Stats(), "test_traffic_0")
+	if loaded == nil || loaded.Online || loaded.RecvBytes != offline.RecvBytes || loaded.Streams != offline.Streams {
+		t.Fatal("loaded stats error", loaded, offline)
+	}
+}
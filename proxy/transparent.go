@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/thread"
+)
+
+func NewTransparentInputer(wg *thread.Group, proto string, addr string, clienttype CLIENT_TYPE, config *Config, father *ProxyConn) (*Inputer, error) {
+	if strings.ToLower(proto) != "tcp" {
+		return nil, errors.New("transparent only support tcp")
+	}
+
+	listener, err := listenTransparentTcp(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &Inputer{
+		clienttype: clienttype,
+		config:     config,
+		proto:      proto,
+		addr:       addr,
+		father:     father,
+		fwg:        wg,
+		listenconn: &netConn{listener: listener},
+	}
+
+	wg.Go("Inputer listenTransparent"+" "+addr, func() error {
+		return input.listenTransparent()
+	})
+
+	loggo.Info("NewInputer ok %s", addr)
+
+	return input, nil
+}
+
+func (i *Inputer) listenTransparent() error {
+
+	loggo.Info("Inputer start listenTransparent %s", i.addr)
+
+	for !i.fwg.IsExit() && !i.isClosed() {
+		conn, err := i.listenconn.Accept()
+		if err != nil {
+			loggo.Info("Inputer listen Accept fail %s", err)
+			continue
+		}
+
+		size := i.sonnySize()
+		if size >= i.config.MaxSonny {
+			loggo.Info("Inputer listen max sonny %s %d", conn.Info(), size)
+			conn.Close()
+			continue
+		}
+
+		targetAddr, err := i.originalDst(conn.(*netConn))
+		if err != nil {
+			loggo.Error("Inputer listenTransparent originalDst fail %s %s", conn.Info(), err)
+			conn.Close()
+			continue
+		}
+
+		proxyconn := &ProxyConn{conn: conn}
+		i.fwg.Go("Inputer processProxyConn"+" "+targetAddr, func() error {
+			atomic.AddInt32(&gStateThreadNum.InputerSonnyThread, 1)
+			defer atomic.AddInt32(&gStateThreadNum.InputerSonnyThread, -1)
+			return i.processProxyConn(proxyconn, targetAddr)
+		})
+	}
+	loggo.Info("Inputer end listenTransparent %s", i.addr)
+	return nil
+}
+
+// REDIRECT时从conntrack取原始目的地址，TPROXY时本地地址就是原始目的地址
+func (i *Inputer) originalDst(conn *netConn) (string, error) {
+	tcpconn, ok := conn.conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not tcp conn")
+	}
+
+	addr, err := getOriginalDst(tcpconn)
+	if err != nil {
+		loggo.Debug("Inputer originalDst getOriginalDst fail %s %s", conn.Info(), err)
+		addr = tcpconn.LocalAddr().(*net.TCPAddr)
+	}
+
+	// 直接连到监听端口的，转发出去会回到自己
+	laddr := i.listenconn.(*netConn).LocalAddr().(*net.TCPAddr)
+	if addr.Port == laddr.Port && (laddr.IP.IsUnspecified() || laddr.IP.Equal(addr.IP)) {
+		return "", errors.New("not redirected " + addr.String())
+	}
+
+	return addr.String(), nil
+}
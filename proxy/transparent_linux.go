@@ -0,0 +1,79 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+const (
+	SO_ORIGINAL_DST      = 80
+	IP6T_SO_ORIGINAL_DST = 80
+	IP_TRANSPARENT       = 19
+	IPV6_TRANSPARENT     = 75
+)
+
+// 尝试打开IP_TRANSPARENT以支持TPROXY，没有权限时只支持REDIRECT
+func listenTransparentTcp(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				err := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, IP_TRANSPARENT, 1)
+				if err != nil {
+					loggo.Info("listenTransparentTcp IP_TRANSPARENT fail %s %s", address, err)
+				}
+				if network == "tcp6" {
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+				}
+			})
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+			// sockaddr_in 正好16字节，借用IPv6Mreq取出来
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, SO_ORIGINAL_DST)
+			if err != nil {
+				serr = err
+				return
+			}
+			ip := make(net.IP, net.IPv4len)
+			copy(ip, mreq.Multiaddr[4:8])
+			addr = &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4]))}
+		} else {
+			// sockaddr_in6 是IPv6MTUInfo的前28字节
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, IP6T_SO_ORIGINAL_DST)
+			if err != nil {
+				serr = err
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, info.Addr.Addr[:])
+			addr = &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return addr, nil
+}
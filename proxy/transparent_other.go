@@ -0,0 +1,16 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+func listenTransparentTcp(addr string) (net.Listener, error) {
+	return nil, errors.New("transparent only support linux")
+}
+
+func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent only support linux")
+}
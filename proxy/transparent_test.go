@@ -0,0 +1,161 @@
+//go:build linux
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+const testTransparentMark = 0x2333
+
+// 设置了这个环境变量说明已经在单独的network namespace里，iptables规则随namespace一起消失
+const testTransparentNetns = "SPP_TEST_TRANSPARENT_NETNS"
+
+// root时在新的network namespace里重新跑这个测试，不碰主机的iptables，返回false表示当前就该跑
+func runTransparentInNetns(t *testing.T) bool {
+	if len(os.Getenv(testTransparentNetns)) > 0 {
+		// 新的namespace里lo默认是down的
+		if out, err := exec.Command("ip", "link", "set", "lo", "up").CombinedOutput(); err != nil {
+			t.Fatal("set lo up fail " + string(out))
+		}
+		return false
+	}
+	if os.Geteuid() != 0 {
+		return false
+	}
+	if _, err := exec.LookPath("unshare"); err != nil {
+		return false
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		return false
+	}
+
+	cmd := exec.Command("unshare", "-n", os.Args[0], "-test.run", "^"+t.Name()+"$", "-test.v", "-test.count=1")
+	cmd.Env = append(os.Environ(), testTransparentNetns+"=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal("netns test fail " + string(out))
+	}
+	if bytes.Contains(out, []byte("--- SKIP")) {
+		reason := "netns test skip"
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.Contains(line, "transparent_test.go") {
+				reason = strings.TrimSpace(line)
+			}
+		}
+		t.Skip(reason)
+	}
+	return true
+}
+
+// 只有打了mark的测试连接才会被REDIRECT，spp自己发出去的连接不受影响
+func tryTransparentConnect(target string) error {
+	d := net.Dialer{
+		Timeout: 2 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, testTransparentMark)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	src := []byte("hello spp transparent")
+	if _, err := conn.Write(src); err != nil {
+		return err
+	}
+	dst := make([]byte, len(src))
+	if _, err := io.ReadFull(conn, dst); err != nil {
+		return err
+	}
+	if !bytes.Equal(src, dst) {
+		return errEchoMismatch
+	}
+	return nil
+}
+
+func Test0008Transparent(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	if runTransparentInNetns(t) {
+		return
+	}
+
+	tcpecho := startEcho(t, "tcp", "127.0.0.1:32502")
+	defer tcpecho.Close()
+
+	config := DefaultConfig()
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:32500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := NewClient(config, "tcp", "127.0.0.1:32500", "test_transparent", "TRANSPARENT", []string{"tcp"}, []string{"127.0.0.1:32501"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	begin := time.Now()
+	for time.Since(begin) < 10*time.Second {
+		conn, err := net.Dial("tcp", "127.0.0.1:32501")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	// 没有被重定向的连接直接关闭
+	if err := tryEcho("tcp", "127.0.0.1:32501"); err == nil {
+		t.Fatal("direct connection should be closed")
+	}
+
+	if len(os.Getenv(testTransparentNetns)) <= 0 {
+		t.Skip("need root and unshare to set iptables in a network namespace")
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip("no iptables")
+	}
+
+	rule := []string{"OUTPUT", "-t", "nat", "-p", "tcp", "-d", "127.0.0.1", "--dport", "32502",
+		"-m", "mark", "--mark", "0x2333", "-j", "REDIRECT", "--to-ports", "32501"}
+	if out, err := exec.Command("iptables", append([]string{"-A"}, rule...)...).CombinedOutput(); err != nil {
+		t.Skip("iptables fail " + string(out))
+	}
+	defer exec.Command("iptables", append([]string{"-D"}, rule...)...).Run()
+
+	var lasterr error
+	begin = time.Now()
+	for time.Since(begin) < 10*time.Second {
+		lasterr = tryTransparentConnect("127.0.0.1:32502")
+		if lasterr == nil {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if lasterr != nil {
+		t.Fatal(lasterr)
+	}
+}
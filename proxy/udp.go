@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/network"
+	"github.com/esrrhs/gohome/thread"
+)
+
+const (
+	MAX_UDP_PACKET_SIZE = 65535
+	UDP_ADDR_CACHE_SIZE = 256         // 一个关联最多缓存多少个解析过的目标
+	UDP_ADDR_CACHE_TTL  = time.Minute // 过了这么久重新解析，域名换了地址也能跟上
+)
+
+type udpAddrEntry struct {
+	addr *net.UDPAddr
+	time time.Time
+}
+
+// 一个关联解析过的目标地址，有数量上限和过期时间
+type udpAddrCache struct {
+	addrs map[string]udpAddrEntry
+}
+
+func newUdpAddrCache() *udpAddrCache {
+	return &udpAddrCache{addrs: make(map[string]udpAddrEntry)}
+}
+
+func (c *udpAddrCache) resolve(addr string) (*net.UDPAddr, error) {
+	now := time.Now()
+	if e, ok := c.addrs[addr]; ok && now.Sub(e.time) < UDP_ADDR_CACHE_TTL {
+		return e.addr, nil
+	}
+
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		delete(c.addrs, addr)
+		return nil, err
+	}
+
+	if len(c.addrs) >= UDP_ADDR_CACHE_SIZE {
+		for k, e := range c.addrs {
+			if now.Sub(e.time) >= UDP_ADDR_CACHE_TTL {
+				delete(c.addrs, k)
+			}
+		}
+		// 都没过期说明目标很多，缓存用处不大，清掉重来
+		if len(c.addrs) >= UDP_ADDR_CACHE_SIZE {
+			c.addrs = make(map[string]udpAddrEntry)
+		}
+	}
+	c.addrs[addr] = udpAddrEntry{addr: to, time: now}
+	return to, nil
+}
+
+// socks5 udp associate的tcp控制连接断开时，整个关联结束
+func checkUdpControl(wg *thread.Group, conn network.Conn) error {
+	loggo.Info("checkUdpControl start %s", conn.Info())
+	buf := make([]byte, 1024)
+	for !wg.IsExit() {
+		_, err := conn.Read(buf)
+		if err != nil {
+			loggo.Info("checkUdpControl Read fail: %s %s", conn.Info(), err.Error())
+			return errors.New("udp control closed")
+		}
+	}
+	loggo.Info("checkUdpControl end %s", conn.Info())
+	return nil
+}
+
+func recvFromUdpClient(wg *thread.Group, recvch *common.Channel, conn *net.UDPConn, clientip net.IP, clientaddr *atomic.Value, maxmsgsize int) error {
+	loggo.Info("recvFromUdpClient start %s", conn.LocalAddr())
+	ds := make([]byte, MAX_UDP_PACKET_SIZE)
+
+	for !wg.IsExit() {
+		n, from, err := conn.ReadFromUDP(ds)
+		if err != nil {
+			loggo.Info("recvFromUdpClient ReadFromUDP fail: %s %s", conn.LocalAddr(), err.Error())
+			return err
+		}
+
+		if !from.IP.Equal(clientip) {
+			loggo.Info("recvFromUdpClient drop other client: %s %s %s", conn.LocalAddr(), from, clientip)
+			continue
+		}
+
+		addr, data, err := socks5UnpackUdp(ds[0:n])
+		if err != nil {
+			loggo.Info("recvFromUdpClient socks5UnpackUdp fail: %s %s", conn.LocalAddr(), err.Error())
+			continue
+		}
+
+		if len(data) <= 0 || len(data) > maxmsgsize {
+			loggo.Info("recvFromUdpClient len error: %s %d", conn.LocalAddr(), len(data))
+			continue
+		}
+
+		clientaddr.Store(from)
+
+		f := &ProxyFrame{}
+		f.Type = FRAME_TYPE_DATA
+		f.DataFrame = &DataFrame{}
+		f.DataFrame.Data = make([]byte, len(data))
+		copy(f.DataFrame.Data, data)
+		f.DataFrame.Addr = addr
+		if loggo.IsDebug() {
+			f.DataFrame.Crc = common.GetCrc32(f.DataFrame.Data)
+		}
+
+		recvch.Write(f)
+
+		if loggo.IsDebug() {
+			loggo.Debug("recvFromUdpClient %s %s %d", conn.LocalAddr(), addr, len(data))
+		}
+
+		atomic.AddInt32(&gState.RecvNum, 1)
+		atomic.AddInt64(&gState.RecvSize, int64(len(f.DataFrame.Data)))
+	}
+	loggo.Info("recvFromUdpClient end %s", conn.LocalAddr())
+	return nil
+}
+
+func sendToUdpClient(wg *thread.Group, sendch *common.Channel, conn *net.UDPConn, clientaddr *atomic.Value) error {
+	loggo.Info("sendToUdpClient start %s", conn.LocalAddr())
+	for !wg.IsExit() {
+		ff := <-sendch.Ch()
+		if ff == nil {
+			break
+		}
+		f := ff.(*ProxyFrame)
+		if f.Type == FRAME_TYPE_CLOSE {
+			loggo.Info("sendToUdpClient close by remote: %s", conn.LocalAddr())
+			return errors.New("close by remote")
+		}
+
+		to, ok := clientaddr.Load().(*net.UDPAddr)
+		if !ok {
+			loggo.Info("sendToUdpClient no client addr: %s", conn.LocalAddr())
+			continue
+		}
+
+		b, err := socks5PackUdp(f.DataFrame.Addr, f.DataFrame.Data)
+		if err != nil {
+			loggo.Info("sendToUdpClient socks5PackUdp fail: %s %s", conn.LocalAddr(), err.Error())
+			continue
+		}
+
+		_, err = conn.WriteToUDP(b, to)
+		if err != nil {
+			loggo.Info("sendToUdpClient WriteToUDP fail: %s %s", conn.LocalAddr(), err.Error())
+			return err
+		}
+
+		atomic.AddInt32(&gState.SendNum, 1)
+		atomic.AddInt64(&gState.SendSize, int64(len(f.DataFrame.Data)))
+	}
+	loggo.Info("sendToUdpClient end %s", conn.LocalAddr())
+	return nil
+}
+
+func recvFromUdpTarget(wg *thread.Group, recvch *common.Channel, conn *net.UDPConn, maxmsgsize int) error {
+	loggo.Info("recvFromUdpTarget start %s", conn.LocalAddr())
+	ds := make([]byte, MAX_UDP_PACKET_SIZE)
+
+	for !wg.IsExit() {
+		n, from, err := conn.ReadFromUDP(ds)
+		if err != nil {
+			loggo.Info("recvFromUdpTarget ReadFromUDP fail: %s %s", conn.LocalAddr(), err.Error())
+			return err
+		}
+
+		if n <= 0 || n > maxmsgsize {
+			loggo.Info("recvFromUdpTarget len error: %s %d", conn.LocalAddr(), n)
+			continue
+		}
+
+		f := &ProxyFrame{}
+		f.Type = FRAME_TYPE_DATA
+		f.DataFrame = &DataFrame{}
+		f.DataFrame.Data = make([]byte, n)
+		copy(f.DataFrame.Data, ds[0:n])
+		f.DataFrame.Addr = from.String()
+		if loggo.IsDebug() {
+			f.DataFrame.Crc = common.GetCrc32(f.DataFrame.Data)
+		}
+
+		recvch.Write(f)
+
+		atomic.AddInt32(&gState.RecvNum, 1)
+		atomic.AddInt64(&gState.RecvSize, int64(len(f.DataFrame.Data)))
+	}
+	loggo.Info("recvFromUdpTarget end %s", conn.LocalAddr())
+	return nil
+}
+
+func sendToUdpTarget(wg *thread.Group, sendch *common.Channel, conn *net.UDPConn) error {
+	loggo.Info("sendToUdpTarget start %s", conn.LocalAddr())
+	addrs := newUdpAddrCache()
+	for !wg.IsExit() {
+		ff := <-sendch.Ch()
+		if ff == nil {
+			break
+		}
+		f := ff.(*ProxyFrame)
+		if f.Type == FRAME_TYPE_CLOSE {
+			loggo.Info("sendToUdpTarget close by remote: %s", conn.LocalAddr())
+			return errors.New("close by remote")
+		}
+
+		to, err := addrs.resolve(f.DataFrame.Addr)
+		if err != nil {
+			loggo.Info("sendToUdpTarget ResolveUDPAddr fail: %s %s %s", conn.LocalAddr(), f.DataFrame.Addr, err.Error())
+			continue
+		}
+
+		_, err = conn.WriteToUDP(f.DataFrame.Data, to)
+		if err != nil {
+			loggo.Info("sendToUdpTarget WriteToUDP fail: %s %s", conn.LocalAddr(), err.Error())
+			continue
+		}
+
+		atomic.AddInt32(&gState.SendNum, 1)
+		atomic.AddInt64(&gState.SendSize, int64(len(f.DataFrame.Data)))
+	}
+	loggo.Info("sendToUdpTarget end %s", conn.LocalAddr())
+	return nil
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/esrrhs/gohome/network"
+)
+
+func checkUpstreamProxy(proxyurl string) error {
+	u, err := url.Parse(proxyurl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "socks5" {
+		return errors.New("upstream proxy scheme must be http or socks5: " + proxyurl)
+	}
+	if len(u.Host) == 0 {
+		return errors.New("upstream proxy no host: " + proxyurl)
+	}
+	// socks5的用户名密码前面只有一个字节的长度
+	if u.Scheme == "socks5" && u.User != nil {
+		password, _ := u.User.Password()
+		if len(u.User.Username()) > 255 || len(password) > 255 {
+			return errors.New("upstream proxy socks5 username or password longer than 255 bytes")
+		}
+	}
+	return nil
+}
+
+// 检查配置时保证了有上游代理的主通道都是tcp
+func dialServer(cn network.Conn, addr string, config *Config) (network.Conn, error) {
+	if len(config.UpstreamProxy) > 0 {
+		return dialUpstream(config.UpstreamProxy, addr, config.ConnectTimeout)
+	}
+	return cn.Dial(addr)
+}
+
+func dialUpstream(proxyurl string, addr string, timeout int) (network.Conn, error) {
+	u, err := url.Parse(proxyurl)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", u.Host, time.Duration(timeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret network.Conn
+	switch u.Scheme {
+	case "http":
+		ret, err = httpConnect(conn, u, addr, timeout)
+	case "socks5":
+		ret, err = socks5Connect(conn, u, addr, timeout)
+	default:
+		err = errors.New("upstream proxy scheme error " + u.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+func httpConnect(conn net.Conn, u *url.URL, addr string, timeout int) (network.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.New("upstream proxy CONNECT fail " + rsp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return newNetConn(conn, reader), nil
+}
+
+func socks5Connect(conn net.Conn, u *url.URL, addr string, timeout int) (network.Conn, error) {
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return nil, err
+	}
+
+	username := ""
+	password := ""
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	if err := socks5Handshake(conn, username, password, timeout); err != nil {
+		return nil, err
+	}
+	if err := network.Sock5SetRequest(conn.(*net.TCPConn), host, port, timeout*1000); err != nil {
+		return nil, err
+	}
+
+	return newNetConn(conn, nil), nil
+}
+
+// network.Sock5Handshake的用户名密码校验有问题，这里自己处理
+func socks5Handshake(conn net.Conn, username string, password string, timeout int) error {
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	method := network.NoAuth
+	if len(username) > 0 || len(password) > 0 {
+		method = network.UserPassAuth
+	}
+
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != 0x05 {
+		return errors.New("upstream socks5 version error " + strconv.Itoa(int(buf[0])))
+	}
+	if buf[1] != method {
+		return errors.New("upstream socks5 method error " + strconv.Itoa(int(buf[1])))
+	}
+
+	if method == network.NoAuth {
+		return nil
+	}
+
+	auth := []byte{0x01, byte(len(username))}
+	auth = append(auth, username...)
+	auth = append(auth, byte(len(password)))
+	auth = append(auth, password...)
+	if _, err := conn.Write(auth); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[1] != 0x00 {
+		return errors.New("upstream socks5 authentication fail")
+	}
+	return nil
+}
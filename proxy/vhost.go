@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/thread"
+)
+
+// reverse_proxy_client的fromaddr写成 http://host/path 或 https://host 时，不单独监听端口，挂到server的vhost上
+type vhostRoute struct {
+	scheme string
+	host   string
+	path   string
+	target string
+	name   string
+	input  *Inputer
+	proxy  *httputil.ReverseProxy
+}
+
+type vhostRouter struct {
+	lock   sync.RWMutex
+	routes map[string][]*vhostRoute // host -> routes，路径前缀长的在前面
+}
+
+func newVhostRouter() *vhostRouter {
+	return &vhostRouter{routes: make(map[string][]*vhostRoute)}
+}
+
+func parseVhostAddr(addr string) (string, string, string, bool) {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		return "", "", "", false
+	}
+	u, err := url.Parse(addr)
+	if err != nil || len(u.Hostname()) <= 0 {
+		return "", "", "", false
+	}
+	path := u.Path
+	if len(path) <= 0 {
+		path = "/"
+	}
+	return u.Scheme, strings.ToLower(u.Hostname()), path, true
+}
+
+func isVhostAddr(addr string) bool {
+	_, _, _, ok := parseVhostAddr(addr)
+	return ok
+}
+
+func vhostHostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func vhostPathMatch(prefix string, path string) bool {
+	if prefix == "/" || prefix == path {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+func (r *vhostRouter) add(route *vhostRoute) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	routes := r.routes[route.host]
+	for _, old := range routes {
+		if old.path == route.path {
+			return errors.New("vhost " + route.host + route.path + " has registered by " + old.name)
+		}
+	}
+	routes = append(routes, route)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].path) > len(routes[j].path)
+	})
+	r.routes[route.host] = routes
+	return nil
+}
+
+func (r *vhostRouter) remove(route *vhostRoute) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	routes := r.routes[route.host]
+	for i, old := range routes {
+		if old == route {
+			routes = append(routes[:i:i], routes[i+1:]...)
+			break
+		}
+	}
+	if len(routes) > 0 {
+		r.routes[route.host] = routes
+	} else {
+		delete(r.routes, route.host)
+	}
+}
+
+func (r *vhostRouter) match(host string, path string) *vhostRoute {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, route := range r.routes[vhostHostname(host)] {
+		if vhostPathMatch(route.path, path) {
+			return route
+		}
+	}
+	return nil
+}
+
+// vhost的Inputer没有自己的监听，连接由server的vhost端口分过来
+func NewVhostInputer(wg *thread.Group, proto string, addr string, clienttype CLIENT_TYPE, config *Config, father *ProxyConn, targetAddr string) (*Inputer, error) {
+	if strings.ToLower(proto) != "tcp" {
+		return nil, errors.New("vhost only support tcp")
+	}
+
+	input := &Inputer{
+		clienttype: clienttype,
+		config:     config,
+		proto:      proto,
+		addr:       addr,
+		father:     father,
+		fwg:        wg,
+	}
+
+	input.transport = &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return input.dialPipe(targetAddr)
+		},
+		DisableCompression:    true,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       time.Duration(config.ConnTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(config.ConnTimeout) * time.Second,
+	}
+
+	loggo.Info("NewInputer ok %s", addr)
+
+	return input, nil
+}
+
+func newVhostRoute(name string, addr string, input *Inputer, targetAddr string) *vhostRoute {
+	scheme, host, path, _ := parseVhostAddr(addr)
+	route := &vhostRoute{
+		scheme: scheme,
+		host:   host,
+		path:   path,
+		target: targetAddr,
+		name:   name,
+		input:  input,
+	}
+	route.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetXForwarded()
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = pr.In.Host
+			pr.Out.Host = pr.In.Host
+		},
+		Transport: input.transport,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			loggo.Error("vhost proxy fail %s %s %s %s", name, req.Host, req.URL.Path, err)
+			writeVhostError(w, req.Host)
+		},
+	}
+	return route
+}
+
+func writeVhostError(w http.ResponseWriter, host string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusBadGateway)
+	io.WriteString(w, "<html><head><title>502 Bad Gateway</title></head><body><h1>502 Bad Gateway</h1><p>"+
+		html.EscapeString(vhostHostname(host))+" is offline</p><hr><p>spp</p></body></html>\n")
+}
+
+func (s *Server) listenVhost(wg *thread.Group) error {
+	if len(s.getConfig().VhostHttp) > 0 {
+		listener, err := net.Listen("tcp", s.getConfig().VhostHttp)
+		if err != nil {
+			return err
+		}
+		s.vhostListeners = append(s.vhostListeners, listener)
+
+		server := NewHttpServer(s.getConfig(), http.HandlerFunc(s.serveVhostHttp))
+		s.vhostServer = server
+		wg.Go("Server vhost http"+" "+s.getConfig().VhostHttp, func() error {
+			loggo.Info("vhost http start %s", s.getConfig().VhostHttp)
+			server.Serve(listener)
+			loggo.Info("vhost http end %s", s.getConfig().VhostHttp)
+			return nil
+		})
+	}
+
+	if len(s.getConfig().VhostHttps) > 0 {
+		listener, err := net.Listen("tcp", s.getConfig().VhostHttps)
+		if err != nil {
+			return err
+		}
+		s.vhostListeners = append(s.vhostListeners, listener)
+
+		wg.Go("Server vhost https"+" "+s.getConfig().VhostHttps, func() error {
+			return s.listenVhostHttps(wg, listener)
+		})
+	}
+	return nil
+}
+
+func (s *Server) serveVhostHttp(w http.ResponseWriter, req *http.Request) {
+	route := s.httpRouter.match(req.Host, req.URL.Path)
+	if route == nil {
+		loggo.Info("serveVhostHttp no route %s %s %s", req.RemoteAddr, req.Host, req.URL.Path)
+		writeVhostError(w, req.Host)
+		return
+	}
+	loggo.Info("serveVhostHttp %s %s %s %s", req.RemoteAddr, req.Host, req.URL.Path, route.name)
+	route.proxy.ServeHTTP(w, req)
+}
+
+func (s *Server) listenVhostHttps(wg *thread.Group, listener net.Listener) error {
+	loggo.Info("vhost https start %s", s.getConfig().VhostHttps)
+	for !wg.IsExit() {
+		conn, err := listener.Accept()
+		if err != nil {
+			loggo.Info("Server vhost https Accept fail %s", err)
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			continue
+		}
+
+		wg.Go("Server processVhostHttps"+" "+conn.RemoteAddr().String(), func() error {
+			s.processVhostHttps(conn)
+			return nil
+		})
+	}
+	loggo.Info("vhost https end %s", s.getConfig().VhostHttps)
+	return nil
+}
+
+// 只看ClientHello里的SNI，不解密，原样转给reverse client
+func (s *Server) processVhostHttps(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Duration(s.getConfig().EstablishedTimeout) * time.Second))
+	sni, hello, err := readTlsSni(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		loggo.Info("processVhostHttps readTlsSni fail %s %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	route := s.httpsRouter.match(sni, "/")
+	if route == nil {
+		loggo.Info("processVhostHttps no route %s %s", conn.RemoteAddr(), sni)
+		conn.Close()
+		return
+	}
+
+	size := route.input.sonnySize()
+	if size >= s.getConfig().MaxSonny {
+		loggo.Info("processVhostHttps max sonny %s %d", conn.RemoteAddr(), size)
+		conn.Close()
+		return
+	}
+
+	loggo.Info("processVhostHttps %s %s %s", conn.RemoteAddr(), sni, route.name)
+
+	proxyconn := &ProxyConn{conn: newNetConn(conn, io.MultiReader(bytes.NewReader(hello), conn))}
+	route.input.fwg.Go("Inputer processProxyConn"+" "+route.target, func() error {
+		atomic.AddInt32(&gStateThreadNum.InputerSonnyThread, 1)
+		defer atomic.AddInt32(&gStateThreadNum.InputerSonnyThread, -1)
+		return route.input.processProxyConn(proxyconn, route.target)
+	})
+}
+
+var errSniDone = errors.New("sni done")
+
+// 读ClientHello的数据都记下来，写出去的都丢掉
+type sniConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *sniConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *sniConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func readTlsSni(conn net.Conn) (string, []byte, error) {
+	var hello bytes.Buffer
+	sni := ""
+	err := tls.Server(&sniConn{Conn: conn, reader: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = info.ServerName
+			return nil, errSniDone
+		},
+	}).Handshake()
+	if !errors.Is(err, errSniDone) {
+		if err == nil {
+			err = errors.New("no client hello")
+		}
+		return "", nil, err
+	}
+	if len(sni) <= 0 {
+		return "", nil, errors.New("no sni")
+	}
+	return sni, hello.Bytes(), nil
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+func startVhostOrigin(t *testing.T, addr string, name string, tlson bool) *httptest.Server {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name + " " + r.Host + " " + r.URL.Path))
+	}))
+	server.Listener.Close()
+	server.Listener = listener
+	if tlson {
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	return server
+}
+
+func tryVhostGet(client *http.Client, target string, host string) (int, string, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Host = host
+	rsp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rsp.Body.Close()
+	b, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	return rsp.StatusCode, string(b), nil
+}
+
+func checkVhostGet(client *http.Client, target string, host string, expect string, timeout time.Duration) error {
+	var err error
+	begin := time.Now()
+	for time.Since(begin) < timeout {
+		var code int
+		var body string
+		code, body, err = tryVhostGet(client, target, host)
+		if err == nil && code == http.StatusOK && body == expect {
+			return nil
+		}
+		if err == nil {
+			err = echoError("vhost " + body)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return err
+}
+
+func Test0010Vhost(t *testing.T) {
+	loggo.Ini(loggo.Config{Level: loggo.LEVEL_ERROR, Prefix: "spptest", NoLogFile: true})
+
+	web := startVhostOrigin(t, "127.0.0.1:32710", "web", false)
+	defer web.Close()
+	api := startVhostOrigin(t, "127.0.0.1:32711", "api", false)
+	defer api.Close()
+	secure := startVhostOrigin(t, "127.0.0.1:32712", "secure", true)
+	defer secure.Close()
+
+	config := DefaultConfig()
+	config.VhostHttp = "127.0.0.1:32701"
+	config.VhostHttps = "127.0.0.1:32702"
+	config.EstablishedTimeout = 2
+	s, err := NewServer(config, []string{"tcp"}, []string{"127.0.0.1:32700"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := NewClient(config, "tcp", "127.0.0.1:32700", "test_vhost_web", "REVERSE_PROXY", []string{"tcp"}, []string{"http://a.spp.test"}, []string{"127.0.0.1:32710"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ac, err := NewClient(config, "tcp", "127.0.0.1:32700", "test_vhost_api", "REVERSE_PROXY", []string{"tcp"}, []string{"http://a.spp.test/api"}, []string{"127.0.0.1:32711"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc, err := NewClient(config, "tcp", "127.0.0.1:32700", "test_vhost_secure", "REVERSE_PROXY", []string{"tcp"}, []string{"https://b.spp.test"}, []string{"127.0.0.1:32712"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: 2 * time.Second}
+
+	if err := checkVhostGet(client, "http://127.0.0.1:32701/index", "a.spp.test", "web a.spp.test /index", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkVhostGet(client, "http://127.0.0.1:32701/api/v1", "A.spp.test:80", "api A.spp.test:80 /api/v1", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkVhostGet(client, "http://127.0.0.1:32701/apix", "a.spp.test", "web a.spp.test /apix", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body, err := tryVhostGet(client, "http://127.0.0.1:32701/", "c.spp.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusBadGateway || !strings.Contains(body, "c.spp.test") {
+		t.Fatal("unknown host should be 502", code, body)
+	}
+
+	// api下线之后，/api 回到web上
+	ac.Close()
+	if err := checkVhostGet(client, "http://127.0.0.1:32701/api/v1", "a.spp.test", "web a.spp.test /api/v1", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	tlstransport := &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: "b.spp.test", InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return net.Dial("tcp", "127.0.0.1:32702")
+		},
+	}
+	defer tlstransport.CloseIdleConnections()
+	tlsclient := &http.Client{Transport: tlstransport, Timeout: 2 * time.Second}
+	if err := checkVhostGet(tlsclient, "https://b.spp.test/secure", "b.spp.test", "secure b.spp.test /secure", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 请求头一直发不完的连接，过了EstablishedTimeout被断开
+	slow, err := net.Dial("tcp", "127.0.0.1:32701")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	slow.Write([]byte("GET / HTTP/1.1\r\nHost: a.spp.test\r\n"))
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(slow); err != nil {
+		t.Fatal("slow header conn should be closed", err)
+	}
+}